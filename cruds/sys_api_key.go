@@ -0,0 +1,186 @@
+package cruds
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/services"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultApiKeyLifetime = 365 * 24 * time.Hour
+
+type createApiKeyRequest struct {
+	Name       string     `json:"name" binding:"required"`
+	Scopes     []string   `json:"scopes" binding:"required"`
+	ReportIDs  []uint     `json:"report_ids"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// CreateApiKey issues a key for the authenticated user on their active
+// site. The key is in the response only; it is stored hashed.
+func CreateApiKey(c *gin.Context, db *gorm.DB) {
+	var req createApiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !services.ValidApiKeyScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope " + scope})
+			return
+		}
+	}
+	for _, entry := range req.AllowedIPs {
+		if err := services.ParseAllowedIP(entry); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	expiresAt := time.Now().Add(defaultApiKeyLifetime)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+			return
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	var user structs.SysUser
+	if err := db.Where("username = ?", c.GetString("username")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Only reports of the key's site can be listed; the IDs of other sites'
+	// reports answer as unknown, as they do everywhere else.
+	reportIDs := make([]string, len(req.ReportIDs))
+	if len(req.ReportIDs) > 0 {
+		var found int64
+		if err := inSite(c, db.Model(&structs.SysMetaRpt{})).Where("id IN ?", req.ReportIDs).Count(&found).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if int(found) != len(req.ReportIDs) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown report in report_ids"})
+			return
+		}
+		for i, id := range req.ReportIDs {
+			reportIDs[i] = strconv.FormatUint(uint64(id), 10)
+		}
+	}
+
+	key, prefix, hash, err := services.GenerateApiKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate API key"})
+		return
+	}
+	record := structs.SysApiKey{
+		Prefix:     prefix,
+		Hash:       hash,
+		Name:       req.Name,
+		UserID:     user.ID,
+		SiteID:     c.GetUint("site_id"),
+		Scopes:     strings.Join(req.Scopes, ","),
+		ReportIDs:  strings.Join(reportIDs, ","),
+		AllowedIPs: strings.Join(req.AllowedIPs, ","),
+		ExpiresAt:  &expiresAt,
+	}
+	if err := db.Create(&record).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"key": key, "api_key": record})
+}
+
+func ListOwnApiKeys(c *gin.Context, db *gorm.DB) {
+	var keys []structs.SysApiKey
+	err := db.Joins("JOIN sys_user ON sys_user.id = sys_api_key.user_id").
+		Where("sys_user.username = ?", c.GetString("username")).
+		Order("sys_api_key.id").Find(&keys).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func RevokeOwnApiKey(c *gin.Context, db *gorm.DB) {
+	var user structs.SysUser
+	if err := db.Where("username = ?", c.GetString("username")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	revokeApiKey(c, db, &user.ID)
+}
+
+// ListApiKeys lists every user's keys, optionally those of one user_id.
+func ListApiKeys(c *gin.Context, db *gorm.DB) {
+	pageStr := strings.TrimSpace(c.DefaultQuery("page", "1"))
+	pageSizeStr := strings.TrimSpace(c.DefaultQuery("pageSize", "10"))
+
+	page, err := strconv.Atoi(pageStr)
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	pageSize, err := strconv.Atoi(pageSizeStr)
+	if err != nil || pageSize < 1 {
+		pageSize = 10
+	}
+
+	var keys []structs.SysApiKey
+	offset := (page - 1) * pageSize
+
+	query := db.Order("id")
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	result := query.Offset(offset).Limit(pageSize).Find(&keys)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"page":     page,
+		"pageSize": pageSize,
+		"results":  keys,
+	})
+}
+
+func RevokeApiKey(c *gin.Context, db *gorm.DB) {
+	revokeApiKey(c, db, nil)
+}
+
+// revokeApiKey revokes the key :id, which must belong to ownerID unless
+// that is nil. Revoked keys are kept so their last use stays visible.
+func revokeApiKey(c *gin.Context, db *gorm.DB, ownerID *uint) {
+	query := db.Where("id = ?", c.Param("id"))
+	if ownerID != nil {
+		query = query.Where("user_id = ?", *ownerID)
+	}
+	var key structs.SysApiKey
+	if err := query.First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		if err := db.Model(&key).Update("revoked_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
+		key.RevokedAt = &now
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked", "api_key": key})
+}
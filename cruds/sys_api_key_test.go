@@ -0,0 +1,56 @@
+package cruds
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"go-report-management/database"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateApiKeyOnlyListsReportsOfTheSite(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&structs.SysMetaRpt{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&structs.SysUser{Username: "alice", Role: structs.RoleUser, Active: true})
+	own, other := uint(1), uint(2)
+	ownReport := structs.SysMetaRpt{Name: "own", SiteID: &own}
+	otherReport := structs.SysMetaRpt{Name: "other", SiteID: &other}
+	sharedReport := structs.SysMetaRpt{Name: "shared"}
+	db.Create(&ownReport)
+	db.Create(&otherReport)
+	db.Create(&sharedReport)
+
+	create := func(reportIDs ...uint) int {
+		body, _ := json.Marshal(gin.H{"name": "ci", "scopes": []string{structs.PermReportRun}, "report_ids": reportIDs})
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api-keys", strings.NewReader(string(body)))
+		c.Set("username", "alice")
+		c.Set("site_id", own)
+		CreateApiKey(c, db)
+		return w.Code
+	}
+
+	if code := create(ownReport.ID, sharedReport.ID); code != http.StatusCreated {
+		t.Fatalf("own and shared reports: got %d, want 201", code)
+	}
+	if code := create(ownReport.ID, otherReport.ID); code != http.StatusBadRequest {
+		t.Fatalf("other site's report: got %d, want 400", code)
+	}
+}
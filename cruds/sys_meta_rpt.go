@@ -2,19 +2,44 @@ package cruds
 
 import (
 	"github.com/gin-gonic/gin"
+	"go-report-management/services"
 	"go-report-management/structs"
+	"go-report-management/utils"
 	"gorm.io/gorm"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
+// inSite limits db to the reports of the active site and the shared ones.
+func inSite(c *gin.Context, db *gorm.DB) *gorm.DB {
+	return db.Where("site_id = ? OR site_id IS NULL", c.GetUint("site_id"))
+}
+
+// CreateReport stores the report under the active site, whatever site_id
+// the body carries. Users without a site create shared reports.
 func CreateReport(c *gin.Context, db *gorm.DB) {
 	var report structs.SysMetaRpt
 	if err := c.ShouldBindJSON(&report); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if _, err := utils.ParseChartSpec(report.Graph); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !services.PermissionsFrom(c).CanInModule(structs.PermReportEdit, report.Module) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + structs.PermReportEdit})
+		return
+	}
+	report.SiteID = nil
+	if siteID := c.GetUint("site_id"); siteID != 0 {
+		report.SiteID = &siteID
+	}
+	if !services.CanWriteReport(c, report) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Shared reports need " + structs.PermReportAdmin})
+		return
+	}
 	if err := db.Create(&report).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -22,21 +47,37 @@ func CreateReport(c *gin.Context, db *gorm.DB) {
 	c.JSON(http.StatusCreated, report)
 }
 
-func GetReport(c *gin.Context, db *gorm.DB) {
-	id := c.Param("id")
+// findReport loads the report named by :id from the active site, answering
+// the request itself if there is none.
+func findReport(c *gin.Context, db *gorm.DB) (structs.SysMetaRpt, bool) {
 	var report structs.SysMetaRpt
-	if err := db.First(&report, id).Error; err != nil {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return report, false
+	}
+	if err := inSite(c, db).First(&report, "id = ?", id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return report, false
+	}
+	return report, true
+}
+
+func GetReport(c *gin.Context, db *gorm.DB) {
+	report, ok := findReport(c, db)
+	if !ok {
 		return
 	}
 	c.JSON(http.StatusOK, report)
 }
 
 func UpdateReport(c *gin.Context, db *gorm.DB) {
-	id := c.Param("id")
-	var report structs.SysMetaRpt
-	if err := db.First(&report, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+	report, ok := findReport(c, db)
+	if !ok {
+		return
+	}
+	if !services.CanWriteReport(c, report) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Shared reports need " + structs.PermReportAdmin})
 		return
 	}
 
@@ -45,14 +86,33 @@ func UpdateReport(c *gin.Context, db *gorm.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if _, err := utils.ParseChartSpec(update.Graph); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Moving a report needs edit rights on the module it moves into too.
+	if update.Module != "" && update.Module != report.Module &&
+		!services.PermissionsFrom(c).CanInModule(structs.PermReportEdit, update.Module) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + structs.PermReportEdit})
+		return
+	}
+	// Reports never move between sites.
+	update.SiteID = nil
 
 	db.Model(&report).Updates(update)
 	c.JSON(http.StatusOK, report)
 }
 
 func DeleteReport(c *gin.Context, db *gorm.DB) {
-	id := c.Param("id")
-	if err := db.Delete(&structs.SysMetaRpt{}, id).Error; err != nil {
+	report, ok := findReport(c, db)
+	if !ok {
+		return
+	}
+	if !services.CanWriteReport(c, report) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Shared reports need " + structs.PermReportAdmin})
+		return
+	}
+	if err := db.Delete(&report).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete report"})
 		return
 	}
@@ -78,7 +138,8 @@ func ListReports(c *gin.Context, db *gorm.DB) {
 	var reports []structs.SysMetaRpt
 	offset := (page - 1) * pageSize
 
-	result := db.Offset(offset).Limit(pageSize).Find(&reports)
+	query := services.PermissionsFrom(c).FilterReports(inSite(c, db), structs.PermReportView)
+	result := query.Offset(offset).Limit(pageSize).Find(&reports)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
 		return
@@ -0,0 +1,135 @@
+package cruds
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type rlsRuleRequest struct {
+	Predicate   string `json:"predicate" binding:"required"`
+	Description string `json:"description"`
+}
+
+func ListRlsRules(c *gin.Context, db *gorm.DB) {
+	var rules []structs.SysRlsRule
+	if err := db.Where("report_id = ?", c.Param("id")).Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+// CreateRlsRule adds a rule to the report. Predicates are a single boolean
+// expression; statement separators and comments would let a rule hide the
+// ones after it, so they are rejected.
+func CreateRlsRule(c *gin.Context, db *gorm.DB) {
+	reportID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+
+	var req rlsRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	predicate := strings.TrimSpace(req.Predicate)
+	if predicate == "" || strings.Contains(predicate, ";") || strings.Contains(predicate, "--") || strings.Contains(predicate, "/*") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid predicate"})
+		return
+	}
+
+	rule := structs.SysRlsRule{ReportID: uint(reportID), Predicate: predicate, Description: req.Description}
+	if err := db.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+func DeleteRlsRule(c *gin.Context, db *gorm.DB) {
+	reportID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+	ruleID, err := strconv.ParseUint(c.Param("rule_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+
+	result := db.Where("id = ? AND report_id = ?", ruleID, reportID).Delete(&structs.SysRlsRule{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete rule"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Rule deleted successfully",
+	})
+}
+
+func GetUserAttributes(c *gin.Context, db *gorm.DB) {
+	var rows []structs.SysUserAttribute
+	if err := db.Where("user_id = ?", c.Param("id")).Order("id").Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	attributes := map[string][]string{}
+	for _, row := range rows {
+		attributes[row.Name] = append(attributes[row.Name], row.Value)
+	}
+	c.JSON(http.StatusOK, attributes)
+}
+
+// SetUserAttributes replaces all of the user's attributes, e.g.
+// {"regions": ["north", "east"]}.
+func SetUserAttributes(c *gin.Context, db *gorm.DB) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+	if err := db.First(&structs.SysUser{}, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var attributes map[string][]string
+	if err := c.ShouldBindJSON(&attributes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rows []structs.SysUserAttribute
+	for name, values := range attributes {
+		for _, value := range values {
+			rows = append(rows, structs.SysUserAttribute{UserID: uint(userID), Name: name, Value: value})
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&structs.SysUserAttribute{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, attributes)
+}
@@ -0,0 +1,252 @@
+package cruds
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/services"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type roleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+type groupMemberRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+// grantRequest assigns RoleID to exactly one of UserID or GroupID. Leaving
+// both Module and ReportID empty grants the role on every report.
+type grantRequest struct {
+	RoleID   uint   `json:"role_id" binding:"required"`
+	UserID   *uint  `json:"user_id"`
+	GroupID  *uint  `json:"group_id"`
+	Module   string `json:"module"`
+	ReportID *uint  `json:"report_id"`
+}
+
+func CreateRole(c *gin.Context, db *gorm.DB) {
+	var req roleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, permission := range req.Permissions {
+		if !services.ValidPermission(permission) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission " + permission})
+			return
+		}
+	}
+
+	role := structs.SysRole{Name: req.Name, Permissions: strings.Join(req.Permissions, ",")}
+	if err := db.Create(&role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, role)
+}
+
+func ListRoles(c *gin.Context, db *gorm.DB) {
+	var roles []structs.SysRole
+	if err := db.Order("name").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+func DeleteRole(c *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", id).Delete(&structs.SysRoleGrant{}).Error; err != nil {
+			return err
+		}
+		return deleteByID(tx, &structs.SysRole{}, id)
+	})
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete role"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Role deleted successfully",
+	})
+}
+
+func CreateGroup(c *gin.Context, db *gorm.DB) {
+	var group structs.SysGroup
+	if err := c.ShouldBindJSON(&group); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(group.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Group name is required"})
+		return
+	}
+	if err := db.Create(&group).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, group)
+}
+
+func ListGroups(c *gin.Context, db *gorm.DB) {
+	var groups []structs.SysGroup
+	if err := db.Order("name").Find(&groups).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+func DeleteGroup(c *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", id).Delete(&structs.SysRoleGrant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(&structs.SysGroupMember{}).Error; err != nil {
+			return err
+		}
+		return deleteByID(tx, &structs.SysGroup{}, id)
+	})
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Group deleted successfully",
+	})
+}
+
+func AddGroupMember(c *gin.Context, db *gorm.DB) {
+	groupID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+	var req groupMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member := structs.SysGroupMember{GroupID: uint(groupID), UserID: req.UserID}
+	if err := db.FirstOrCreate(&member, member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, member)
+}
+
+func RemoveGroupMember(c *gin.Context, db *gorm.DB) {
+	if err := db.Where("group_id = ? AND user_id = ?", c.Param("id"), c.Param("user_id")).Delete(&structs.SysGroupMember{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove group member"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Group member removed successfully",
+	})
+}
+
+func CreateGrant(c *gin.Context, db *gorm.DB) {
+	var req grantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.UserID == nil) == (req.GroupID == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exactly one of user_id or group_id is required"})
+		return
+	}
+	if req.Module != "" && req.ReportID != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A grant is either per module or per report"})
+		return
+	}
+	if err := db.First(&structs.SysRole{}, req.RoleID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+		return
+	}
+
+	grant := structs.SysRoleGrant{
+		RoleID:   req.RoleID,
+		UserID:   req.UserID,
+		GroupID:  req.GroupID,
+		Module:   req.Module,
+		ReportID: req.ReportID,
+	}
+	if err := db.Create(&grant).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, grant)
+}
+
+func ListGrants(c *gin.Context, db *gorm.DB) {
+	query := db.Order("id")
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if groupID := c.Query("group_id"); groupID != "" {
+		query = query.Where("group_id = ?", groupID)
+	}
+
+	var grants []structs.SysRoleGrant
+	if err := query.Find(&grants).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, grants)
+}
+
+func DeleteGrant(c *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+	err = deleteByID(db, &structs.SysRoleGrant{}, id)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Grant not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete grant"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Grant deleted successfully",
+	})
+}
+
+// deleteByID deletes the row of model with primary key id, reporting
+// gorm.ErrRecordNotFound if there was none.
+func deleteByID(db *gorm.DB, model interface{}, id uint64) error {
+	result := db.Where("id = ?", id).Delete(model)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
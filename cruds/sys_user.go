@@ -0,0 +1,371 @@
+package cruds
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/services"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const minPasswordLength = 8
+
+type createUserRequest struct {
+	Username           string `json:"username" binding:"required"`
+	Password           string `json:"password" binding:"required"`
+	Email              string `json:"email"`
+	DisplayName        string `json:"display_name"`
+	Role               string `json:"role"`
+	Active             *bool  `json:"active"`
+	MustChangePassword *bool  `json:"must_change_password"`
+}
+
+type updateUserRequest struct {
+	Email              *string `json:"email"`
+	DisplayName        *string `json:"display_name"`
+	Role               *string `json:"role"`
+	MustChangePassword *bool   `json:"must_change_password"`
+	// OidcSubject links the user to an identity provider account; an
+	// empty string unlinks it.
+	OidcSubject *string `json:"oidc_subject"`
+}
+
+type setPasswordRequest struct {
+	Password           string `json:"password" binding:"required"`
+	MustChangePassword *bool  `json:"must_change_password"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+func validRole(role string) bool {
+	return role == structs.RoleAdmin || role == structs.RoleUser
+}
+
+func CreateUser(c *gin.Context, db *gorm.DB) {
+	var req createUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = structs.RoleUser
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters"})
+		return
+	}
+
+	var count int64
+	db.Model(&structs.SysUser{}).Where("username = ?", req.Username).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+		return
+	}
+
+	hash, err := services.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not hash password"})
+		return
+	}
+
+	// New accounts change the password an admin picked for them unless the
+	// admin says otherwise.
+	mustChange := true
+	if req.MustChangePassword != nil {
+		mustChange = *req.MustChangePassword
+	}
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	user := structs.SysUser{
+		Username:           req.Username,
+		Password:           hash,
+		Email:              req.Email,
+		DisplayName:        req.DisplayName,
+		Role:               req.Role,
+		Active:             active,
+		MustChangePassword: mustChange,
+	}
+	// gorm leaves a false Active out of the INSERT in favour of the column
+	// default, so a disabled account is written in a second step.
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if !active {
+			return tx.Model(&user).Update("active", false).Error
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, user)
+}
+
+// findUser loads the user named by :id, answering the request itself if
+// there is none.
+func findUser(c *gin.Context, db *gorm.DB) (structs.SysUser, bool) {
+	var user structs.SysUser
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return user, false
+	}
+	if err := db.First(&user, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return user, false
+	}
+	return user, true
+}
+
+func GetUser(c *gin.Context, db *gorm.DB) {
+	user, ok := findUser(c, db)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func UpdateUser(c *gin.Context, db *gorm.DB) {
+	user, ok := findUser(c, db)
+	if !ok {
+		return
+	}
+
+	var req updateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A map rather than the struct so false and empty values are written.
+	updates := map[string]interface{}{}
+	if req.Email != nil {
+		updates["email"] = *req.Email
+	}
+	if req.DisplayName != nil {
+		updates["display_name"] = *req.DisplayName
+	}
+	if req.Role != nil {
+		if !validRole(*req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+			return
+		}
+		if *req.Role != structs.RoleAdmin && user.Username == c.GetString("username") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You can't remove your own admin role"})
+			return
+		}
+		updates["role"] = *req.Role
+	}
+	if req.MustChangePassword != nil {
+		updates["must_change_password"] = *req.MustChangePassword
+	}
+	if req.OidcSubject != nil {
+		if *req.OidcSubject == "" {
+			updates["oidc_subject"] = nil
+		} else {
+			var count int64
+			db.Model(&structs.SysUser{}).Where("oidc_subject = ? AND id <> ?", *req.OidcSubject, user.ID).Count(&count)
+			if count > 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "Subject is linked to another user"})
+				return
+			}
+			updates["oidc_subject"] = *req.OidcSubject
+		}
+	}
+
+	if len(updates) > 0 {
+		if err := db.Model(&user).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// SetUserActive disables or re-enables a user. Disabled users can't log in,
+// and their sessions are revoked.
+func SetUserActive(c *gin.Context, db *gorm.DB, active bool) {
+	user, ok := findUser(c, db)
+	if !ok {
+		return
+	}
+	if !active && user.Username == c.GetString("username") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't disable your own account"})
+		return
+	}
+
+	if err := db.Model(&user).Update("active", active).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !active {
+		if err := services.RevokeAllSessions(db, &user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func DeleteUser(c *gin.Context, db *gorm.DB) {
+	user, ok := findUser(c, db)
+	if !ok {
+		return
+	}
+	if user.Username == c.GetString("username") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't delete your own account"})
+		return
+	}
+
+	// Nothing of the user may outlive the account: a later user could get
+	// the same ID, and a leftover API key would still authenticate.
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{
+			&structs.SysRefreshToken{},
+			&structs.SysApiKey{},
+			&structs.SysUserSite{},
+			&structs.SysUserAttribute{},
+			&structs.SysGroupMember{},
+			&structs.SysRoleGrant{},
+		} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User deleted successfully",
+	})
+}
+
+func ListUsers(c *gin.Context, db *gorm.DB) {
+	pageStr := strings.TrimSpace(c.DefaultQuery("page", "1"))
+	pageSizeStr := strings.TrimSpace(c.DefaultQuery("pageSize", "10"))
+
+	page, err := strconv.Atoi(pageStr)
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	pageSize, err := strconv.Atoi(pageSizeStr)
+	if err != nil || pageSize < 1 {
+		pageSize = 10
+	}
+
+	var users []structs.SysUser
+	offset := (page - 1) * pageSize
+
+	query := db.Order("id")
+	if active := c.Query("active"); active != "" {
+		query = query.Where("active = ?", active == "true" || active == "1")
+	}
+
+	result := query.Offset(offset).Limit(pageSize).Find(&users)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"page":     page,
+		"pageSize": pageSize,
+		"results":  users,
+	})
+}
+
+// SetUserPassword lets an admin reset a user's password and ends the
+// user's sessions. The user has to change it on next login unless
+// must_change_password is sent as false.
+func SetUserPassword(c *gin.Context, db *gorm.DB) {
+	user, ok := findUser(c, db)
+	if !ok {
+		return
+	}
+
+	var req setPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters"})
+		return
+	}
+
+	hash, err := services.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not hash password"})
+		return
+	}
+	mustChange := true
+	if req.MustChangePassword != nil {
+		mustChange = *req.MustChangePassword
+	}
+
+	updates := map[string]interface{}{"password": hash, "must_change_password": mustChange}
+	if err := db.Model(&user).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.RevokeAllSessions(db, &user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
+}
+
+// ChangeOwnPassword is the self-service counterpart of SetUserPassword: it
+// requires the current password and clears must_change_password.
+func ChangeOwnPassword(c *gin.Context, db *gorm.DB) {
+	var user structs.SysUser
+	if err := db.Where("username = ?", c.GetString("username")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var req changePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if ok, _ := services.VerifyPassword(req.CurrentPassword, user.Password); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect password"})
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters"})
+		return
+	}
+
+	hash, err := services.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not hash password"})
+		return
+	}
+
+	updates := map[string]interface{}{"password": hash, "must_change_password": false}
+	if err := db.Model(&user).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
+}
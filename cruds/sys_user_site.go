@@ -0,0 +1,68 @@
+package cruds
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+)
+
+type userSiteRequest struct {
+	SiteID  uint `json:"site_id" binding:"required"`
+	Default bool `json:"default"`
+}
+
+func ListUserSites(c *gin.Context, db *gorm.DB) {
+	var memberships []structs.SysUserSite
+	if err := db.Where("user_id = ?", c.Param("id")).Order("site_id").Find(&memberships).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, memberships)
+}
+
+// AddUserSite makes the user a member of a site, or updates the membership
+// if it exists. A user has at most one default site.
+func AddUserSite(c *gin.Context, db *gorm.DB) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+	if err := db.First(&structs.SysUser{}, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var req userSiteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	membership := structs.SysUserSite{UserID: uint(userID), SiteID: req.SiteID, IsDefault: req.Default}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if req.Default {
+			if err := tx.Model(&structs.SysUserSite{}).Where("user_id = ?", userID).Update("is_default", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&membership).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, membership)
+}
+
+func RemoveUserSite(c *gin.Context, db *gorm.DB) {
+	if err := db.Where("user_id = ? AND site_id = ?", c.Param("id"), c.Param("site_id")).Delete(&structs.SysUserSite{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove site membership"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Site membership removed successfully",
+	})
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"log"
+	"os"
+)
+
+// Migrate adds the tables and columns the app expects. AutoMigrate only
+// creates and widens; it never drops existing data.
+func Migrate(db *gorm.DB) error {
+	// Databases from before user management have neither column; their
+	// accounts must stay usable after the upgrade.
+	hadActive := db.Migrator().HasColumn(&structs.SysUser{}, "active")
+	hadRole := db.Migrator().HasColumn(&structs.SysUser{}, "role")
+
+	err := db.AutoMigrate(
+		&structs.SysUser{},
+		&structs.SysRole{},
+		&structs.SysGroup{},
+		&structs.SysGroupMember{},
+		&structs.SysRoleGrant{},
+		&structs.SysUserSite{},
+		&structs.SysRlsRule{},
+		&structs.SysUserAttribute{},
+		&structs.SysRefreshToken{},
+		&structs.SysSigningKey{},
+		&structs.SysApiKey{},
+		&structs.SysOidcState{},
+		&structs.SysJobEvent{},
+	)
+	if err != nil {
+		return err
+	}
+
+	if !hadActive {
+		if err := db.Model(&structs.SysUser{}).Where("1 = 1").Update("active", true).Error; err != nil {
+			return err
+		}
+	}
+	return bootstrapAdmin(db, !hadRole)
+}
+
+// bootstrapAdmin makes sure someone can manage users when there is no
+// admin: INITIAL_ADMIN names the account to promote. Right after the role
+// column is added, the oldest account is promoted if INITIAL_ADMIN is unset.
+func bootstrapAdmin(db *gorm.DB, rolesAdded bool) error {
+	var admins int64
+	if err := db.Model(&structs.SysUser{}).Where("role = ?", structs.RoleAdmin).Count(&admins).Error; err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+
+	var user structs.SysUser
+	var err error
+	if username := os.Getenv("INITIAL_ADMIN"); username != "" {
+		err = db.Where("username = ?", username).First(&user).Error
+	} else if rolesAdded {
+		err = db.Order("id").First(&user).Error
+	} else {
+		return nil
+	}
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("no admin account; promoting %s to admin", user.Username)
+	return db.Model(&user).Updates(map[string]interface{}{"role": structs.RoleAdmin, "active": true}).Error
+}
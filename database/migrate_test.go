@@ -0,0 +1,69 @@
+package database
+
+import (
+	"github.com/glebarez/sqlite"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateKeepsExistingUsersUsable(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sys_user as it was before user management.
+	db.Exec("CREATE TABLE sys_user (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT, password TEXT)")
+	db.Exec("INSERT INTO sys_user (username, password) VALUES ('first', 'x'), ('second', 'y')")
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var users []structs.SysUser
+	db.Order("id").Find(&users)
+	if len(users) != 2 {
+		t.Fatalf("got %d users", len(users))
+	}
+	for _, user := range users {
+		if !user.Active {
+			t.Fatalf("%s disabled by the upgrade", user.Username)
+		}
+	}
+	if users[0].Role != structs.RoleAdmin || users[1].Role != structs.RoleUser {
+		t.Fatalf("got roles %q and %q, want the oldest account promoted", users[0].Role, users[1].Role)
+	}
+
+	// Later runs leave roles alone.
+	db.Model(&users[0]).Update("active", false)
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&users[0], users[0].ID)
+	if users[0].Active {
+		t.Fatal("a second migration re-enabled a disabled account")
+	}
+}
+
+func TestMigratePromotesInitialAdmin(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&structs.SysUser{Username: "first", Role: structs.RoleUser})
+	db.Create(&structs.SysUser{Username: "ops", Role: structs.RoleUser})
+
+	t.Setenv("INITIAL_ADMIN", "ops")
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var ops structs.SysUser
+	db.Where("username = ?", "ops").First(&ops)
+	if ops.Role != structs.RoleAdmin {
+		t.Fatalf("got role %q, want admin", ops.Role)
+	}
+}
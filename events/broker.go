@@ -0,0 +1,74 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Broker carries published messages between app instances. Every instance
+// runs the same Broker and hands what it receives to its local Bus, so a
+// job on one replica reaches a user connected to another.
+//
+// Sequence numbers are assigned by the broker and increase across all
+// users, so a client's last-seen sequence is meaningful on any replica.
+type Broker interface {
+	Publish(user string, message Message) error
+	// Replay returns the retained messages for user with
+	// afterSeq < Seq <= uptoSeq, oldest first.
+	Replay(user string, afterSeq, uptoSeq uint64) ([]Message, error)
+	// Head is the sequence of the newest message published before Run.
+	Head() uint64
+	// Run starts handing every message published on any instance to
+	// deliver, once and in sequence order, except that a message whose
+	// write committed late may follow higher sequences. It must not block.
+	Run(deliver func(user string, message Message))
+}
+
+// MemoryBroker is the single-node Broker: delivery is synchronous and the
+// replay log lives in process memory.
+type MemoryBroker struct {
+	publishMu sync.Mutex
+	seq       uint64
+	deliver   func(user string, message Message)
+	replay    *replayLog
+}
+
+func NewMemoryBroker(maxMessages int, retention time.Duration) *MemoryBroker {
+	broker := &MemoryBroker{replay: newReplayLog(maxMessages, retention)}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			broker.replay.sweep()
+		}
+	}()
+	return broker
+}
+
+func (b *MemoryBroker) Publish(user string, message Message) error {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	b.seq++
+	message.Seq = b.seq
+	b.replay.append(user, message)
+	if b.deliver != nil {
+		b.deliver(user, message)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Replay(user string, afterSeq, uptoSeq uint64) ([]Message, error) {
+	return b.replay.between(user, afterSeq, uptoSeq), nil
+}
+
+func (b *MemoryBroker) Head() uint64 {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+	return b.seq
+}
+
+func (b *MemoryBroker) Run(deliver func(user string, message Message)) {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+	b.deliver = deliver
+}
@@ -0,0 +1,165 @@
+package events
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	subscriptionBufferSize = 256
+	defaultPollInterval    = 500 * time.Millisecond
+)
+
+// Subscription receives every message published to User after it was
+// created, preceded by the retained messages it asked to replay. C is
+// closed when the subscription ends, either through Unsubscribe or because
+// the subscriber fell too far behind.
+type Subscription struct {
+	User string
+	C    <-chan Message
+	c    chan Message
+	// replayed holds the Seqs queued by Subscribe. A row that commits late
+	// can be read by Replay and then reach deliver as well; it is skipped
+	// there once.
+	replayed map[uint64]bool
+}
+
+// Bus is the single source of job events for every transport on this
+// instance. Publishing goes through the broker, which hands every message,
+// including those from other instances, back to deliver. Delivery never
+// blocks: a subscriber whose buffer is full is dropped so one slow client
+// can't stall everyone else.
+type Bus struct {
+	mu        sync.Mutex
+	subs      map[string]map[*Subscription]bool
+	broker    Broker
+	delivered uint64
+}
+
+func NewBus(broker Broker) *Bus {
+	bus := &Bus{subs: make(map[string]map[*Subscription]bool), broker: broker, delivered: broker.Head()}
+	broker.Run(bus.deliver)
+	return bus
+}
+
+var BusInstance *Bus
+
+// InitBus picks the broker from EVENT_BROKER ("memory", the default, or
+// "mysql" for deployments with more than one replica) and applies the
+// replay settings from the environment.
+func InitBus(db *sql.DB) {
+	maxMessages := defaultReplayMessages
+	if n, err := strconv.Atoi(os.Getenv("WS_REPLAY_MESSAGES")); err == nil && n > 0 {
+		maxMessages = n
+	}
+	retention := defaultReplayRetention
+	if d, err := time.ParseDuration(os.Getenv("WS_REPLAY_RETENTION")); err == nil && d > 0 {
+		retention = d
+	}
+
+	var broker Broker
+	switch os.Getenv("EVENT_BROKER") {
+	case "mysql":
+		pollInterval := defaultPollInterval
+		if d, err := time.ParseDuration(os.Getenv("EVENT_POLL_INTERVAL")); err == nil && d > 0 {
+			pollInterval = d
+		}
+		mysqlBroker, err := NewMySQLBroker(db, maxMessages, retention, pollInterval)
+		if err != nil {
+			log.Fatalf("Failed to start MySQL event broker: %v", err)
+		}
+		broker = mysqlBroker
+	default:
+		broker = NewMemoryBroker(maxMessages, retention)
+	}
+
+	BusInstance = NewBus(broker)
+}
+
+// Subscribe registers a subscriber for user and queues every retained
+// message after lastSeq. Replay stops at the last delivered sequence and
+// runs under mu, so no message is either missed or delivered twice, though
+// with the MySQL broker a late commit may arrive after higher Seqs.
+func (b *Bus) Subscribe(user string, lastSeq uint64) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []Message
+	if lastSeq > 0 && lastSeq < b.delivered {
+		var err error
+		missed, err = b.broker.Replay(user, lastSeq, b.delivered)
+		if err != nil {
+			log.Printf("error replaying events for user %s: %v", user, err)
+		}
+	}
+
+	c := make(chan Message, subscriptionBufferSize+len(missed))
+	replayed := make(map[uint64]bool, len(missed))
+	for _, message := range missed {
+		c <- message
+		replayed[message.Seq] = true
+	}
+	sub := &Subscription{User: user, C: c, c: c, replayed: replayed}
+
+	subs, ok := b.subs[user]
+	if !ok {
+		subs = make(map[*Subscription]bool)
+		b.subs[user] = subs
+	}
+	subs[sub] = true
+	return sub
+}
+
+// Unsubscribe ends sub. It is safe to call more than once.
+func (b *Bus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unsubscribeLocked(sub)
+}
+
+func (b *Bus) unsubscribeLocked(sub *Subscription) {
+	subs, ok := b.subs[sub.User]
+	if !ok || !subs[sub] {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subs, sub.User)
+	}
+	close(sub.c)
+}
+
+func (b *Bus) Publish(user string, message Message) {
+	if err := b.broker.Publish(user, message); err != nil {
+		log.Printf("error publishing event for user %s: %v", user, err)
+	}
+}
+
+func (b *Bus) deliver(user string, message Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if message.Seq > b.delivered {
+		b.delivered = message.Seq
+	}
+	for sub := range b.subs[user] {
+		if sub.replayed[message.Seq] {
+			delete(sub.replayed, message.Seq)
+			continue
+		}
+		select {
+		case sub.c <- message:
+		default:
+			log.Printf("dropping slow event subscriber for user %s", user)
+			b.unsubscribeLocked(sub)
+		}
+	}
+}
+
+func Publish(user string, message Message) {
+	BusInstance.Publish(user, message)
+}
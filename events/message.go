@@ -0,0 +1,27 @@
+package events
+
+const (
+	MessageQueued    = "queued"
+	MessageProgress  = "progress"
+	MessageCompleted = "completed"
+	MessageFailed    = "failed"
+	MessageCancelled = "cancelled"
+)
+
+// Message is a job event. Seq is assigned by the Broker and increases
+// across all users, so one user's sequence numbers have gaps; Version is
+// filled in by each transport for the protocol it speaks.
+type Message struct {
+	Version    int     `json:"v"`
+	Seq        uint64  `json:"seq,omitempty"`
+	Type       string  `json:"type"`
+	JobID      string  `json:"job_id,omitempty"`
+	ReportID   int     `json:"report_id,omitempty"`
+	Phase      string  `json:"phase,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	RowsDone   int     `json:"rows_done,omitempty"`
+	RowsTotal  int     `json:"rows_total,omitempty"`
+	ETASeconds int     `json:"eta_seconds,omitempty"`
+	URL        string  `json:"url,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
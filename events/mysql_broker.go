@@ -0,0 +1,186 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	mysqlPollBatch = 500
+	// mysqlRescanWindow covers inserts that commit out of id order: every
+	// poll looks this many ids back and skips what it already delivered.
+	// Such a row is delivered after the higher ids that committed first.
+	mysqlRescanWindow = 100
+)
+
+// MySQLBroker shares events between replicas through the sys_job_event
+// table. Each instance polls for new rows and delivers them locally; the
+// row id is the message sequence number. database.Migrate creates the
+// table.
+type MySQLBroker struct {
+	db           *sql.DB
+	maxMessages  int
+	retention    time.Duration
+	pollInterval time.Duration
+	lastID       uint64
+	seen         map[uint64]bool
+}
+
+func NewMySQLBroker(db *sql.DB, maxMessages int, retention, pollInterval time.Duration) (*MySQLBroker, error) {
+	broker := &MySQLBroker{
+		db:           db,
+		maxMessages:  maxMessages,
+		retention:    retention,
+		pollInterval: pollInterval,
+		seen:         make(map[uint64]bool),
+	}
+
+	var lastID sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(id) FROM sys_job_event").Scan(&lastID); err != nil {
+		return nil, fmt.Errorf("error reading sys_job_event: %w", err)
+	}
+	broker.lastID = uint64(lastID.Int64)
+
+	// Events from before the start were never ours to deliver; without
+	// marking them seen, the first poll would rescan and redeliver them.
+	rows, err := db.Query("SELECT id FROM sys_job_event WHERE id > ?", broker.rescanFrom())
+	if err != nil {
+		return nil, fmt.Errorf("error reading sys_job_event: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		broker.seen[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return broker, nil
+}
+
+// rescanFrom is the id polling resumes after.
+func (b *MySQLBroker) rescanFrom() uint64 {
+	if b.lastID > mysqlRescanWindow {
+		return b.lastID - mysqlRescanWindow
+	}
+	return 0
+}
+
+func (b *MySQLBroker) Publish(user string, message Message) error {
+	message.Seq = 0
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("INSERT INTO sys_job_event (username, payload) VALUES (?, ?)", user, payload)
+	return err
+}
+
+func (b *MySQLBroker) Replay(user string, afterSeq, uptoSeq uint64) ([]Message, error) {
+	rows, err := b.db.Query(`SELECT id, payload FROM (
+		SELECT id, payload FROM sys_job_event
+		WHERE username = ? AND id > ? AND id <= ? AND created_at >= ?
+		ORDER BY id DESC LIMIT ?
+	) AS recent ORDER BY id`, user, afterSeq, uptoSeq, time.Now().Add(-b.retention), b.maxMessages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var id uint64
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			return nil, err
+		}
+		message, err := decodeEvent(id, payload)
+		if err != nil {
+			log.Printf("skipping malformed event %d: %v", id, err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (b *MySQLBroker) Head() uint64 {
+	return b.lastID
+}
+
+func (b *MySQLBroker) Run(deliver func(user string, message Message)) {
+	go func() {
+		poll := time.NewTicker(b.pollInterval)
+		sweep := time.NewTicker(time.Minute)
+		defer poll.Stop()
+		defer sweep.Stop()
+
+		for {
+			select {
+			case <-poll.C:
+				if err := b.poll(deliver); err != nil {
+					log.Printf("error polling sys_job_event: %v", err)
+				}
+			case <-sweep.C:
+				if _, err := b.db.Exec("DELETE FROM sys_job_event WHERE created_at < ?", time.Now().Add(-b.retention)); err != nil {
+					log.Printf("error pruning sys_job_event: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (b *MySQLBroker) poll(deliver func(user string, message Message)) error {
+	from := b.rescanFrom()
+
+	rows, err := b.db.Query("SELECT id, username, payload FROM sys_job_event WHERE id > ? ORDER BY id LIMIT ?", from, mysqlPollBatch+mysqlRescanWindow)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint64
+		var user string
+		var payload []byte
+		if err := rows.Scan(&id, &user, &payload); err != nil {
+			return err
+		}
+		if b.seen[id] || id <= from {
+			continue
+		}
+		b.seen[id] = true
+		if id > b.lastID {
+			b.lastID = id
+		}
+
+		message, err := decodeEvent(id, payload)
+		if err != nil {
+			log.Printf("skipping malformed event %d: %v", id, err)
+			continue
+		}
+		deliver(user, message)
+	}
+
+	for id := range b.seen {
+		if id+mysqlRescanWindow < b.lastID {
+			delete(b.seen, id)
+		}
+	}
+	return rows.Err()
+}
+
+func decodeEvent(id uint64, payload []byte) (Message, error) {
+	var message Message
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return Message{}, err
+	}
+	message.Seq = id
+	return message, nil
+}
@@ -0,0 +1,57 @@
+package events
+
+import (
+	"github.com/glebarez/sqlite"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMySQLBrokerSkipsEventsFromBeforeStart(t *testing.T) {
+	gormDB, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gormDB.AutoMigrate(&structs.SysJobEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := gormDB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written by this or another replica before the restart.
+	publisher := &MySQLBroker{db: db}
+	for i := 0; i < 3; i++ {
+		if err := publisher.Publish("alice", Message{Type: "job_progress"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker, err := NewMySQLBroker(db, 10, time.Hour, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delivered []uint64
+	deliver := func(user string, message Message) { delivered = append(delivered, message.Seq) }
+
+	if err := broker.poll(deliver); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("first poll redelivered %v", delivered)
+	}
+
+	if err := broker.Publish("alice", Message{Type: "job_progress"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.poll(deliver); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 || delivered[0] != 4 {
+		t.Fatalf("got %v, want [4]", delivered)
+	}
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplayMessages  = 100
+	defaultReplayRetention = time.Hour
+)
+
+type storedMessage struct {
+	message Message
+	at      time.Time
+}
+
+// replayLog keeps the most recent messages sent to each user so a client
+// that reconnects with ?last_seq=N gets everything after N. Retention is
+// bounded both by count and by age.
+type replayLog struct {
+	mu          sync.Mutex
+	maxMessages int
+	retention   time.Duration
+	messages    map[string][]storedMessage
+}
+
+func newReplayLog(maxMessages int, retention time.Duration) *replayLog {
+	return &replayLog{
+		maxMessages: maxMessages,
+		retention:   retention,
+		messages:    make(map[string][]storedMessage),
+	}
+}
+
+// append records message, which already carries its sequence number.
+func (l *replayLog) append(user string, message Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	messages := append(l.prune(l.messages[user], now), storedMessage{message: message, at: now})
+	if len(messages) > l.maxMessages {
+		messages = messages[len(messages)-l.maxMessages:]
+	}
+	l.messages[user] = messages
+}
+
+// between returns the retained messages for user with afterSeq < Seq <= uptoSeq.
+func (l *replayLog) between(user string, afterSeq, uptoSeq uint64) []Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var missed []Message
+	for _, stored := range l.prune(l.messages[user], time.Now()) {
+		if stored.message.Seq > afterSeq && stored.message.Seq <= uptoSeq {
+			missed = append(missed, stored.message)
+		}
+	}
+	return missed
+}
+
+func (l *replayLog) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for user, messages := range l.messages {
+		if messages = l.prune(messages, now); len(messages) == 0 {
+			delete(l.messages, user)
+		} else {
+			l.messages[user] = messages
+		}
+	}
+}
+
+func (l *replayLog) prune(messages []storedMessage, now time.Time) []storedMessage {
+	cutoff := now.Add(-l.retention)
+	i := 0
+	for i < len(messages) && messages[i].at.Before(cutoff) {
+		i++
+	}
+	return messages[i:]
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"expvar"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"go-report-management/events"
+	"go-report-management/services"
+	"go-report-management/websockets"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const sseKeepAlive = 15 * time.Second
+
+var activeEventStreams = expvar.NewInt("sse_streams_active")
+
+// JobEventsHandler streams the same job events as the WebSocket hub over
+// Server-Sent Events, for clients behind proxies that break upgrades. The
+// event id is the message sequence, so EventSource resumes through
+// Last-Event-ID on its own.
+func JobEventsHandler(c *gin.Context, db *gorm.DB) {
+	tokenString := streamToken(c)
+	if tokenString == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "token is required"})
+		return
+	}
+
+	claims, _, err := services.AuthenticateAccessToken(db, tokenString)
+	if err != nil {
+		c.JSON(services.AccessErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	lastSeq, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+	sub := events.BusInstance.Subscribe(claims.Username, lastSeq)
+	defer events.BusInstance.Unsubscribe(sub)
+
+	activeEventStreams.Add(1)
+	defer activeEventStreams.Add(-1)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case message, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			message.Version = websockets.ProtocolV1
+			c.Render(-1, sse.Event{
+				Id:    strconv.FormatUint(message.Seq, 10),
+				Event: message.Type,
+				Data:  message,
+			})
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keepalive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"go-report-management/cruds"
 	"go-report-management/services"
+	"go-report-management/structs"
+	"go-report-management/utils"
 	"gorm.io/gorm"
 	"net/http"
 	"strconv"
@@ -30,6 +33,18 @@ func ListReportsHandler(c *gin.Context, db *gorm.DB) {
 	cruds.ListReports(c, db)
 }
 
+func ListRlsRulesHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListRlsRules(c, db)
+}
+
+func CreateRlsRuleHandler(c *gin.Context, db *gorm.DB) {
+	cruds.CreateRlsRule(c, db)
+}
+
+func DeleteRlsRuleHandler(c *gin.Context, db *gorm.DB) {
+	cruds.DeleteRlsRule(c, db)
+}
+
 func GenerateExcelReportHandler(c *gin.Context, db *sql.DB, reportQueue chan int, blockSize int) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -43,12 +58,27 @@ func GenerateExcelReportHandler(c *gin.Context, db *sql.DB, reportQueue chan int
 		return
 	}
 
+	pivot, err := utils.ParsePivotSpec(c.Query("pivot"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	filters := extractFilters(c)
-	reportQueue <- id
+	job := startExport(db, reportQueue, blockSize, id, clientID, services.ScopeFrom(c), filters, pivot)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Excel report generation in progress", "job_id": job.ID})
+}
+
+// startExport queues an Excel export of reportID for scope. Both the HTTP
+// handler and the WebSocket start_export command go through here.
+func startExport(db *sql.DB, reportQueue chan int, blockSize, reportID int, clientID string, scope services.QueryScope, filters map[string]string, pivot *structs.PivotSpec) *services.Job {
+	job := services.NewJob(reportID, clientID, scope)
+	reportQueue <- reportID
+	job.Queued()
 	go func() {
-		services.GenerateReport(db, id, blockSize, filters, clientID)
+		services.GenerateReport(db, job, blockSize, filters, pivot)
 	}()
-	c.JSON(http.StatusAccepted, gin.H{"message": "Excel report generation in progress"})
+	return job
 }
 
 func GetReportDataPaginatedHandler(c *gin.Context, db *sql.DB) {
@@ -74,23 +104,175 @@ func GetReportDataPaginatedHandler(c *gin.Context, db *sql.DB) {
 	offset := (page - 1) * limit
 
 	filters := extractFilters(c)
-	results, err := services.GetReportDataPaginated(db, id, limit, offset, filters)
+	results, err := services.GetReportDataPaginated(db, services.ScopeFrom(c), id, limit, offset, filters)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"page":     page,
+		"pageSize": limit,
+		"results":  results,
+	})
+}
+
+func GetReportChartHandler(c *gin.Context, db *sql.DB) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+
+	maxCategories, err := strconv.Atoi(c.DefaultQuery("max_categories", strconv.Itoa(services.DefaultChartCategories)))
+	if err != nil || maxCategories < 1 {
+		maxCategories = services.DefaultChartCategories
+	}
+	if maxCategories > services.MaxChartCategories {
+		maxCategories = services.MaxChartCategories
+	}
+
+	filters := extractFilters(c)
+	data, err := services.GetChartData(db, services.ScopeFrom(c), id, filters, maxCategories)
+	if err == services.ErrNoChart {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+func GetReportAggregateHandler(c *gin.Context, db *sql.DB, dbormi *gorm.DB, reportQueue chan int, blockSize int) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+
+	spec, err := services.ParseAggregateSpec(c.Query("group_by"), c.Query("metrics"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filters := extractFilters(c)
+
+	if c.Query("export") == "excel" {
+		// Checked against the request's permissions, which an API key may
+		// have narrowed; canRun already found the report in this site.
+		var report structs.SysMetaRpt
+		if err := dbormi.Select("id", "module", "site_id").First(&report, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+			return
+		}
+		if !services.PermissionsFrom(c).Can(structs.PermReportExport, report) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + structs.PermReportExport})
+			return
+		}
+		clientID := c.Query("clientid")
+		if clientID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing clientID"})
+			return
+		}
+		// Built once up front so a bad column is a 400 rather than a
+		// failed job.
+		if _, err := services.BuildAggregateSQL(db, services.ScopeFrom(c), id, filters, spec); err != nil {
+			c.JSON(queryErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		job := services.NewJob(id, clientID, services.ScopeFrom(c))
+		reportQueue <- id
+		job.Queued()
+		go func() {
+			services.GenerateAggregateReport(db, job, blockSize, filters, spec)
+		}()
+		c.JSON(http.StatusAccepted, gin.H{"message": "Excel report generation in progress", "job_id": job.ID})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 {
+		limit = 10
+	}
+
+	offset := (page - 1) * limit
+
+	results, total, err := services.GetAggregateDataPaginated(db, services.ScopeFrom(c), id, limit, offset, filters, spec)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(queryErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"page":     page,
 		"pageSize": limit,
+		"total":    total,
 		"results":  results,
 	})
 }
 
+func GetReportPivotHandler(c *gin.Context, db *sql.DB) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+		return
+	}
+
+	pivot, err := utils.ParsePivotSpec(c.Query("pivot"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if pivot == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing pivot"})
+		return
+	}
+
+	filters := extractFilters(c)
+	data, err := services.GetPivotData(db, services.ScopeFrom(c), id, filters, pivot)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+// queryErrorStatus answers a services.ValidationError, a query the client
+// got wrong, with 400 and anything else with 500.
+func queryErrorStatus(err error) int {
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+var reservedParams = map[string]bool{
+	"id":             true,
+	"page":           true,
+	"limit":          true,
+	"clientid":       true,
+	"max_categories": true,
+	"group_by":       true,
+	"metrics":        true,
+	"export":         true,
+	"pivot":          true,
+}
+
 func extractFilters(c *gin.Context) map[string]string {
 	filters := make(map[string]string)
 	for key, values := range c.Request.URL.Query() {
-		if key != "id" && key != "page" && key != "limit" && key != "clientid" {
+		if !reservedParams[key] {
 			filters[key] = values[0]
 		}
 	}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/cruds"
+	"gorm.io/gorm"
+)
+
+func CreateRoleHandler(c *gin.Context, db *gorm.DB) {
+	cruds.CreateRole(c, db)
+}
+
+func ListRolesHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListRoles(c, db)
+}
+
+func DeleteRoleHandler(c *gin.Context, db *gorm.DB) {
+	cruds.DeleteRole(c, db)
+}
+
+func CreateGroupHandler(c *gin.Context, db *gorm.DB) {
+	cruds.CreateGroup(c, db)
+}
+
+func ListGroupsHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListGroups(c, db)
+}
+
+func DeleteGroupHandler(c *gin.Context, db *gorm.DB) {
+	cruds.DeleteGroup(c, db)
+}
+
+func AddGroupMemberHandler(c *gin.Context, db *gorm.DB) {
+	cruds.AddGroupMember(c, db)
+}
+
+func RemoveGroupMemberHandler(c *gin.Context, db *gorm.DB) {
+	cruds.RemoveGroupMember(c, db)
+}
+
+func CreateGrantHandler(c *gin.Context, db *gorm.DB) {
+	cruds.CreateGrant(c, db)
+}
+
+func ListGrantsHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListGrants(c, db)
+}
+
+func DeleteGrantHandler(c *gin.Context, db *gorm.DB) {
+	cruds.DeleteGrant(c, db)
+}
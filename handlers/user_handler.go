@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/cruds"
+	"gorm.io/gorm"
+)
+
+func CreateUserHandler(c *gin.Context, db *gorm.DB) {
+	cruds.CreateUser(c, db)
+}
+
+func GetUserHandler(c *gin.Context, db *gorm.DB) {
+	cruds.GetUser(c, db)
+}
+
+func UpdateUserHandler(c *gin.Context, db *gorm.DB) {
+	cruds.UpdateUser(c, db)
+}
+
+func DisableUserHandler(c *gin.Context, db *gorm.DB) {
+	cruds.SetUserActive(c, db, false)
+}
+
+func EnableUserHandler(c *gin.Context, db *gorm.DB) {
+	cruds.SetUserActive(c, db, true)
+}
+
+func DeleteUserHandler(c *gin.Context, db *gorm.DB) {
+	cruds.DeleteUser(c, db)
+}
+
+func ListUsersHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListUsers(c, db)
+}
+
+func SetUserPasswordHandler(c *gin.Context, db *gorm.DB) {
+	cruds.SetUserPassword(c, db)
+}
+
+func ChangeOwnPasswordHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ChangeOwnPassword(c, db)
+}
+
+func ListUserSitesHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListUserSites(c, db)
+}
+
+func AddUserSiteHandler(c *gin.Context, db *gorm.DB) {
+	cruds.AddUserSite(c, db)
+}
+
+func RemoveUserSiteHandler(c *gin.Context, db *gorm.DB) {
+	cruds.RemoveUserSite(c, db)
+}
+
+func GetUserAttributesHandler(c *gin.Context, db *gorm.DB) {
+	cruds.GetUserAttributes(c, db)
+}
+
+func SetUserAttributesHandler(c *gin.Context, db *gorm.DB) {
+	cruds.SetUserAttributes(c, db)
+}
+
+func CreateApiKeyHandler(c *gin.Context, db *gorm.DB) {
+	cruds.CreateApiKey(c, db)
+}
+
+func ListOwnApiKeysHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListOwnApiKeys(c, db)
+}
+
+func RevokeOwnApiKeyHandler(c *gin.Context, db *gorm.DB) {
+	cruds.RevokeOwnApiKey(c, db)
+}
+
+func ListApiKeysHandler(c *gin.Context, db *gorm.DB) {
+	cruds.ListApiKeys(c, db)
+}
+
+func RevokeApiKeyHandler(c *gin.Context, db *gorm.DB) {
+	cruds.RevokeApiKey(c, db)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"go-report-management/services"
+	"go-report-management/structs"
+	"go-report-management/utils"
+	"go-report-management/websockets"
+	"gorm.io/gorm"
+)
+
+// WsCommands answers the commands clients send over the WebSocket, with the
+// same report permissions as the HTTP routes. Permissions are loaded per
+// command so grant changes apply to open connections.
+func WsCommands(db *sql.DB, dbormi *gorm.DB, reportQueue chan int, blockSize int) websockets.CommandHandler {
+	return func(client *websockets.Client, cmd websockets.Command) (interface{}, error) {
+		scope := services.QueryScope{Username: client.User, SiteID: client.SiteID}
+		switch cmd.Type {
+		case websockets.CommandStartExport:
+			if cmd.Format != "" && cmd.Format != "excel" {
+				return nil, fmt.Errorf("unsupported format: %s", cmd.Format)
+			}
+			if cmd.ReportID < 1 {
+				return nil, fmt.Errorf("invalid ID format")
+			}
+			if err := services.CheckReportPermission(dbormi, scope, client.IssuedAt, cmd.ReportID, structs.PermReportExport); err != nil {
+				return nil, err
+			}
+			pivot, err := utils.ParsePivotSpec(string(cmd.Pivot))
+			if err != nil {
+				return nil, err
+			}
+			filters := cmd.Filters
+			if filters == nil {
+				filters = map[string]string{}
+			}
+			job := startExport(db, reportQueue, blockSize, cmd.ReportID, client.ID, scope, filters, pivot)
+			return job.Info(), nil
+
+		case websockets.CommandCancel:
+			if err := services.CancelJob(cmd.JobID, client.User); err != nil {
+				return nil, err
+			}
+			return nil, nil
+
+		case websockets.CommandSubscribe:
+			job, err := services.GetJob(cmd.JobID)
+			if err != nil {
+				return nil, err
+			}
+			// Subscribers receive the download link, so watching a job
+			// takes the same permission as starting it.
+			if err := services.CheckReportPermission(dbormi, scope, client.IssuedAt, job.ReportID, structs.PermReportExport); err != nil {
+				return nil, err
+			}
+			// The job runs with its owner's row policies; only users bound
+			// to the same ones may see its progress and file.
+			if err := job.CheckSubscriber(db, scope); err != nil {
+				return nil, err
+			}
+			job.Subscribe(client.User)
+			return job.Info(), nil
+
+		case websockets.CommandUnsubscribe:
+			job, err := services.GetJob(cmd.JobID)
+			if err != nil {
+				return nil, err
+			}
+			job.Unsubscribe(client.User)
+			return nil, nil
+
+		case websockets.CommandListJobs:
+			return services.ListJobs(client.User), nil
+		}
+		return nil, fmt.Errorf("unknown command: %s", cmd.Type)
+	}
+}
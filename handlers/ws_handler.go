@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go-report-management/services"
+	"go-report-management/websockets"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const bearerSubprotocol = "bearer."
+
+// ServeWsHandler authenticates the WebSocket handshake before upgrading.
+// Browsers can't set an Authorization header on a WebSocket, so the token may
+// also come as ?token= or as a "bearer.<token>" Sec-WebSocket-Protocol entry.
+// A client sending the bearer entry must offer reports.v1 next to it: the
+// server has to select one of the offered subprotocols or browsers fail the
+// handshake, and it must never select the one carrying the token.
+func ServeWsHandler(c *gin.Context, db *gorm.DB) {
+	if offersBearerSubprotocol(c.Request) && !offersSubprotocol(c.Request, websockets.SubprotocolV1) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the bearer subprotocol must be offered together with " + websockets.SubprotocolV1})
+		return
+	}
+
+	tokenString := streamToken(c)
+	if tokenString == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "token is required"})
+		return
+	}
+
+	claims, _, err := services.AuthenticateAccessToken(db, tokenString)
+	if err != nil {
+		c.JSON(services.AccessErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	clientID := c.Param("clientID")
+	websockets.ServeWs(websockets.HubInstance, c.Writer, c.Request, clientID, claims.Username, claims.SiteID, issuedAt)
+}
+
+// streamToken finds the access token for long-lived streams (WebSocket and
+// SSE), where browsers can't always send an Authorization header.
+func streamToken(c *gin.Context) string {
+	if token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); token != c.GetHeader("Authorization") {
+		return token
+	}
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(c.Request) {
+		if strings.HasPrefix(protocol, bearerSubprotocol) {
+			return strings.TrimPrefix(protocol, bearerSubprotocol)
+		}
+	}
+	return ""
+}
+
+func offersBearerSubprotocol(r *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, bearerSubprotocol) {
+			return true
+		}
+	}
+	return false
+}
+
+func offersSubprotocol(r *http.Request, name string) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == name {
+			return true
+		}
+	}
+	return false
+}
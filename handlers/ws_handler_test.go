@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/websocket"
+	"go-report-management/database"
+	"go-report-management/events"
+	"go-report-management/services"
+	"go-report-management/structs"
+	"go-report-management/websockets"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHandshakeTest serves /ws/:clientID from a fresh database with a
+// signing key, and returns a user of it.
+func newHandshakeTest(t *testing.T) (*gorm.DB, *httptest.Server, structs.SysUser) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// InitKeyRing reads .env from the working directory.
+	wd, _ := os.Getwd()
+	if err := os.WriteFile(filepath.Join(dir, ".env"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(dir)
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("JWT_KEY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err := services.InitKeyRing(db); err != nil {
+		t.Fatal(err)
+	}
+	websockets.InitHub(events.NewBus(events.NewMemoryBroker(10, time.Minute)))
+
+	user := structs.SysUser{Username: "alice", Role: structs.RoleUser, Active: true}
+	db.Create(&user)
+
+	router := gin.New()
+	router.GET("/ws/:clientID", func(c *gin.Context) { ServeWsHandler(c, db) })
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return db, server, user
+}
+
+func dialWs(t *testing.T, server *httptest.Server, token string) int {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/c1"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if conn != nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestWsHandshakeRejectsRevokedSessions(t *testing.T) {
+	db, server, user := newHandshakeTest(t)
+	token, err := services.GenerateJWT(user.Username, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := dialWs(t, server, token); status != http.StatusSwitchingProtocols {
+		t.Fatalf("valid token: got %d, want 101", status)
+	}
+
+	if err := services.RevokeAllSessions(db, &user); err != nil {
+		t.Fatal(err)
+	}
+	if status := dialWs(t, server, token); status != http.StatusUnauthorized {
+		t.Fatalf("after log out all: got %d, want 401", status)
+	}
+}
+
+func TestWsHandshakeRejectsDisabledUsers(t *testing.T) {
+	db, server, user := newHandshakeTest(t)
+	token, err := services.GenerateJWT(user.Username, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&user).Update("active", false)
+	if status := dialWs(t, server, token); status != http.StatusForbidden {
+		t.Fatalf("disabled user: got %d, want 403", status)
+	}
+}
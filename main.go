@@ -4,9 +4,12 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"go-report-management/database"
+	"go-report-management/events"
 	"go-report-management/routes"
+	"go-report-management/services"
 	"go-report-management/websockets"
 	"log"
+	"os"
 	"sync"
 	"time"
 )
@@ -36,18 +39,34 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	if err := database.Migrate(dbormi); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	if err := services.InitKeyRing(dbormi); err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+	if err := services.InitAuthenticators(); err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+
 	router := gin.Default()
+	// API key IP allow-lists rely on ClientIP, so X-Forwarded-For is only
+	// believed from the proxies listed here; by default from none.
+	if err := router.SetTrustedProxies(services.SplitList(os.Getenv("TRUSTED_PROXIES"))); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	config := cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Content-Type", "Authorization", services.ApiKeyHeader},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 	}
 	router.Use(cors.New(config))
 
-	websockets.InitHub()
+	events.InitBus(db)
+	websockets.InitHub(events.BusInstance)
 	routes.SetupRoutes(router, db, dbormi, reportQueue, blockSize)
 
 	filters := map[string]string{}
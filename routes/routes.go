@@ -2,9 +2,11 @@ package routes
 
 import (
 	"database/sql"
+	"expvar"
 	"github.com/gin-gonic/gin"
 	"go-report-management/handlers"
 	"go-report-management/services"
+	"go-report-management/structs"
 	"go-report-management/websockets"
 	"gorm.io/gorm"
 	"sync"
@@ -12,30 +14,108 @@ import (
 
 func SetupRoutes(router *gin.Engine, db *sql.DB, dbormi *gorm.DB, reportQueue chan int, blockSize int) {
 	router.POST("/login", func(c *gin.Context) { services.Login(c, dbormi) })
-	router.POST("/refresh-token", func(c *gin.Context) { services.RefreshToken(c) })
+	router.POST("/refresh-token", func(c *gin.Context) { services.RefreshToken(c, dbormi) })
+	router.POST("/logout", func(c *gin.Context) { services.Logout(c, dbormi) })
+	router.GET("/.well-known/jwks.json", services.JWKSHandler)
+	router.GET("/oidc/login", func(c *gin.Context) { services.OIDCLogin(c, dbormi) })
+	router.GET("/oidc/callback", func(c *gin.Context) { services.OIDCCallback(c, dbormi) })
 
 	authorized := router.Group("/")
-	authorized.Use(services.AuthenticateJWT())
+	authorized.Use(services.AuthenticateJWT(dbormi))
 	{
-		authorized.GET("/report/:id", func(c *gin.Context) {
+		canView := services.RequireReportPermission(dbormi, structs.PermReportView)
+		canRun := services.RequireReportPermission(dbormi, structs.PermReportRun)
+		canExport := services.RequireReportPermission(dbormi, structs.PermReportExport)
+		canEdit := services.RequireReportPermission(dbormi, structs.PermReportEdit)
+		canAdmin := services.RequireReportPermission(dbormi, structs.PermReportAdmin)
+
+		authorized.GET("/report/:id", canRun, func(c *gin.Context) {
 			handlers.GetReportDataPaginatedHandler(c, db)
 		})
 
-		authorized.GET("/report/:id/:clientid/excel", func(c *gin.Context) {
+		authorized.GET("/report/:id/chart", canRun, func(c *gin.Context) {
+			handlers.GetReportChartHandler(c, db)
+		})
+
+		authorized.GET("/report/:id/aggregate", canRun, func(c *gin.Context) {
+			handlers.GetReportAggregateHandler(c, db, dbormi, reportQueue, blockSize)
+		})
+
+		authorized.GET("/report/:id/pivot", canRun, func(c *gin.Context) {
+			handlers.GetReportPivotHandler(c, db)
+		})
+
+		authorized.GET("/report/:id/:clientid/excel", canExport, func(c *gin.Context) {
 			handlers.GenerateExcelReportHandler(c, db, reportQueue, blockSize)
 		})
 
+		// Creating and listing are checked against the body and the grants
+		// in the cruds, since there is no report ID to check yet.
 		authorized.POST("/reports", func(c *gin.Context) { handlers.CreateReportHandler(c, dbormi) })
-		authorized.GET("/reports/:id", func(c *gin.Context) { handlers.GetReportByIDHandler(c, dbormi) })
-		authorized.PUT("/reports/:id", func(c *gin.Context) { handlers.UpdateReportHandler(c, dbormi) })
-		authorized.DELETE("/reports/:id", func(c *gin.Context) { handlers.DeleteReportHandler(c, dbormi) })
+		authorized.GET("/reports/:id", canView, func(c *gin.Context) { handlers.GetReportByIDHandler(c, dbormi) })
+		authorized.PUT("/reports/:id", canEdit, func(c *gin.Context) { handlers.UpdateReportHandler(c, dbormi) })
+		authorized.DELETE("/reports/:id", canAdmin, func(c *gin.Context) { handlers.DeleteReportHandler(c, dbormi) })
 		authorized.GET("/reports", func(c *gin.Context) { handlers.ListReportsHandler(c, dbormi) })
+		authorized.GET("/reports/:id/rls-rules", canAdmin, func(c *gin.Context) { handlers.ListRlsRulesHandler(c, dbormi) })
+		authorized.POST("/reports/:id/rls-rules", canAdmin, func(c *gin.Context) { handlers.CreateRlsRuleHandler(c, dbormi) })
+		authorized.DELETE("/reports/:id/rls-rules/:rule_id", canAdmin, func(c *gin.Context) { handlers.DeleteRlsRuleHandler(c, dbormi) })
+
+	}
+
+	// Account routes need a user session; an API key can't reach them.
+	session := authorized.Group("/")
+	session.Use(services.RequireUserSession())
+	{
+		session.POST("/me/password", func(c *gin.Context) { handlers.ChangeOwnPasswordHandler(c, dbormi) })
+		session.POST("/logout/all", func(c *gin.Context) { services.LogoutAll(c, dbormi) })
+		session.GET("/me/sites", func(c *gin.Context) { services.ListOwnSites(c, dbormi) })
+		session.POST("/me/site", func(c *gin.Context) { services.SwitchSite(c, dbormi) })
+		session.POST("/api-keys", func(c *gin.Context) { handlers.CreateApiKeyHandler(c, dbormi) })
+		session.GET("/api-keys", func(c *gin.Context) { handlers.ListOwnApiKeysHandler(c, dbormi) })
+		session.DELETE("/api-keys/:id", func(c *gin.Context) { handlers.RevokeOwnApiKeyHandler(c, dbormi) })
+
+		session.GET("/debug/vars", services.RequirePermission(structs.PermReportAdmin), gin.WrapH(expvar.Handler()))
+	}
+
+	admin := session.Group("/admin")
+	admin.Use(services.RequireAdmin(dbormi))
+	{
+		admin.POST("/users", func(c *gin.Context) { handlers.CreateUserHandler(c, dbormi) })
+		admin.GET("/users", func(c *gin.Context) { handlers.ListUsersHandler(c, dbormi) })
+		admin.GET("/users/:id", func(c *gin.Context) { handlers.GetUserHandler(c, dbormi) })
+		admin.PUT("/users/:id", func(c *gin.Context) { handlers.UpdateUserHandler(c, dbormi) })
+		admin.DELETE("/users/:id", func(c *gin.Context) { handlers.DeleteUserHandler(c, dbormi) })
+		admin.POST("/users/:id/disable", func(c *gin.Context) { handlers.DisableUserHandler(c, dbormi) })
+		admin.POST("/users/:id/enable", func(c *gin.Context) { handlers.EnableUserHandler(c, dbormi) })
+		admin.PUT("/users/:id/password", func(c *gin.Context) { handlers.SetUserPasswordHandler(c, dbormi) })
+		admin.GET("/users/:id/attributes", func(c *gin.Context) { handlers.GetUserAttributesHandler(c, dbormi) })
+		admin.PUT("/users/:id/attributes", func(c *gin.Context) { handlers.SetUserAttributesHandler(c, dbormi) })
+		admin.GET("/users/:id/sites", func(c *gin.Context) { handlers.ListUserSitesHandler(c, dbormi) })
+		admin.POST("/users/:id/sites", func(c *gin.Context) { handlers.AddUserSiteHandler(c, dbormi) })
+		admin.DELETE("/users/:id/sites/:site_id", func(c *gin.Context) { handlers.RemoveUserSiteHandler(c, dbormi) })
+		admin.GET("/api-keys", func(c *gin.Context) { handlers.ListApiKeysHandler(c, dbormi) })
+		admin.DELETE("/api-keys/:id", func(c *gin.Context) { handlers.RevokeApiKeyHandler(c, dbormi) })
+	}
+
+	rbac := session.Group("/admin")
+	rbac.Use(services.RequirePermission(structs.PermReportAdmin))
+	{
+		rbac.POST("/roles", func(c *gin.Context) { handlers.CreateRoleHandler(c, dbormi) })
+		rbac.GET("/roles", func(c *gin.Context) { handlers.ListRolesHandler(c, dbormi) })
+		rbac.DELETE("/roles/:id", func(c *gin.Context) { handlers.DeleteRoleHandler(c, dbormi) })
+		rbac.POST("/groups", func(c *gin.Context) { handlers.CreateGroupHandler(c, dbormi) })
+		rbac.GET("/groups", func(c *gin.Context) { handlers.ListGroupsHandler(c, dbormi) })
+		rbac.DELETE("/groups/:id", func(c *gin.Context) { handlers.DeleteGroupHandler(c, dbormi) })
+		rbac.POST("/groups/:id/members", func(c *gin.Context) { handlers.AddGroupMemberHandler(c, dbormi) })
+		rbac.DELETE("/groups/:id/members/:user_id", func(c *gin.Context) { handlers.RemoveGroupMemberHandler(c, dbormi) })
+		rbac.POST("/grants", func(c *gin.Context) { handlers.CreateGrantHandler(c, dbormi) })
+		rbac.GET("/grants", func(c *gin.Context) { handlers.ListGrantsHandler(c, dbormi) })
+		rbac.DELETE("/grants/:id", func(c *gin.Context) { handlers.DeleteGrantHandler(c, dbormi) })
 	}
 
-	router.GET("/ws/:clientID", func(c *gin.Context) {
-		clientID := c.Param("clientID")
-		websockets.ServeWs(websockets.HubInstance, c.Writer, c.Request, clientID)
-	})
+	websockets.HubInstance.Commands = handlers.WsCommands(db, dbormi, reportQueue, blockSize)
+	router.GET("/ws/:clientID", func(c *gin.Context) { handlers.ServeWsHandler(c, dbormi) })
+	router.GET("/jobs/events", func(c *gin.Context) { handlers.JobEventsHandler(c, dbormi) })
 }
 
 func ProcessReports(db *sql.DB, reportQueue chan int, semaphore chan struct{}, wg *sync.WaitGroup, blockSize int, filters map[string]string) {
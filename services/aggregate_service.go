@@ -0,0 +1,188 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"go-report-management/utils"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var metricPattern = regexp.MustCompile(`^\s*([A-Za-z_]+)\(\s*(\*|[A-Za-z_][A-Za-z0-9_ ]*?)\s*\)\s*$`)
+
+// ValidationError is a query the client asked for that can't be run as
+// asked, such as an unknown column or a malformed metric. Handlers answer
+// it with 400 rather than 500.
+type ValidationError struct {
+	message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.message
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &ValidationError{message: fmt.Sprintf(format, args...)}
+}
+
+type Metric struct {
+	Function string
+	Column   string
+	Alias    string
+}
+
+type AggregateSpec struct {
+	GroupBy []string
+	Metrics []Metric
+}
+
+func ParseAggregateSpec(groupBy, metrics string) (*AggregateSpec, error) {
+	spec := &AggregateSpec{}
+	for _, column := range strings.Split(groupBy, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			spec.GroupBy = append(spec.GroupBy, column)
+		}
+	}
+
+	for _, raw := range strings.Split(metrics, ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		match := metricPattern.FindStringSubmatch(raw)
+		if match == nil {
+			return nil, invalidf("invalid metric: %q", raw)
+		}
+		fn := strings.ToLower(match[1])
+		if _, ok := aggregateFunctions[fn]; !ok {
+			return nil, invalidf("unsupported aggregate function: %s", match[1])
+		}
+		if match[2] == "*" && fn != "count" {
+			return nil, invalidf("only count accepts *")
+		}
+
+		alias := fn + "_" + strings.ReplaceAll(match[2], " ", "_")
+		if match[2] == "*" {
+			alias = fn + "_all"
+		}
+		spec.Metrics = append(spec.Metrics, Metric{Function: fn, Column: match[2], Alias: alias})
+	}
+
+	if len(spec.GroupBy) == 0 && len(spec.Metrics) == 0 {
+		return nil, invalidf("group_by or metrics is required")
+	}
+	return spec, nil
+}
+
+// BuildAggregateSQL wraps the report query as a subquery and groups it by
+// spec. Every column is checked against the columns the report returns.
+func BuildAggregateSQL(db *sql.DB, scope QueryScope, reportID int, filters map[string]string, spec *AggregateSpec) (string, error) {
+	rq, err := GetQueryByID(db, reportID, scope)
+	if err != nil {
+		return "", fmt.Errorf("error getting query by ID: %v", err)
+	}
+	havingClause, err := buildHavingClause(filters)
+	if err != nil {
+		return "", err
+	}
+	source := reportSubquery(rq, havingClause)
+
+	// Probed without the filters, which would fail the probe itself if they
+	// named a column the report doesn't have.
+	allowed, err := reportColumns(db, reportSubquery(rq, ""))
+	if err != nil {
+		return "", fmt.Errorf("error getting report columns: %v", err)
+	}
+	for column := range filters {
+		if !allowed[column] {
+			return "", invalidf("unknown filter column: %s", column)
+		}
+	}
+
+	var groups, selects []string
+	for _, column := range spec.GroupBy {
+		if !allowed[column] {
+			return "", invalidf("unknown column: %s", column)
+		}
+		quoted, err := quoteIdentifier(column)
+		if err != nil {
+			return "", invalidf("%v", err)
+		}
+		groups = append(groups, quoted)
+		selects = append(selects, quoted)
+	}
+
+	for _, metric := range spec.Metrics {
+		column := metric.Column
+		if column != "*" {
+			if !allowed[column] {
+				return "", invalidf("unknown column: %s", column)
+			}
+			if column, err = quoteIdentifier(column); err != nil {
+				return "", invalidf("%v", err)
+			}
+		}
+		alias, err := quoteIdentifier(metric.Alias)
+		if err != nil {
+			return "", invalidf("%v", err)
+		}
+		selects = append(selects, fmt.Sprintf("%s(%s) AS %s", aggregateFunctions[metric.Function], column, alias))
+	}
+
+	aggregateSQL := fmt.Sprintf("SELECT %s FROM (%s) AS aggregate_data", strings.Join(selects, ", "), source)
+	if len(groups) > 0 {
+		aggregateSQL += fmt.Sprintf(" GROUP BY %s ORDER BY %s", strings.Join(groups, ", "), strings.Join(groups, ", "))
+	}
+	return aggregateSQL, nil
+}
+
+func GetAggregateDataPaginated(db *sql.DB, scope QueryScope, reportID, limit, offset int, filters map[string]string, spec *AggregateSpec) ([]map[string]interface{}, int, error) {
+	aggregateSQL, err := BuildAggregateSQL(db, scope, reportID, filters, spec)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := countSQL(db, aggregateSQL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting groups: %v", err)
+	}
+
+	results, _, err := querySQL(db, aggregateSQL, offset, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error executing query: %v", err)
+	}
+	return results, total, nil
+}
+
+func GenerateAggregateReport(db *sql.DB, job *Job, blockSize int, filters map[string]string, spec *AggregateSpec) {
+	aggregateSQL, err := BuildAggregateSQL(db, job.scope, job.ReportID, filters, spec)
+	if err != nil {
+		log.Printf("error building aggregate query: %v", err)
+		job.failed(err)
+		return
+	}
+
+	specs, err := GetColumnSpecsByID(db, job.ReportID)
+	if err != nil {
+		log.Printf("error getting column specs: %v", err)
+	}
+	exportSQL(db, job, aggregateSQL, blockSize, utils.NewExcelWriter(specs))
+}
+
+func reportColumns(db *sql.DB, source string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM (%s) AS column_probe LIMIT 0", source))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool, len(cols))
+	for _, col := range cols {
+		allowed[col] = true
+	}
+	return allowed, nil
+}
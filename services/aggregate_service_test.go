@@ -0,0 +1,34 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAggregateRequestErrorsAreValidationErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		groupBy string
+		metrics string
+	}{
+		{"empty", "", ""},
+		{"malformed metric", "", "sum(amount"},
+		{"unknown function", "", "median(amount)"},
+		{"star outside count", "", "sum(*)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseAggregateSpec(tt.groupBy, tt.metrics)
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("got %v, want a ValidationError", err)
+			}
+		})
+	}
+
+	_, err := buildHavingClause(map[string]string{"amount`) OR 1=1 --": "x"})
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("filter: got %v, want a ValidationError", err)
+	}
+}
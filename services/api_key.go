@@ -0,0 +1,225 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ApiKeyPrefix starts every key, so it can be told apart from a JWT and
+	// spotted by secret scanners.
+	ApiKeyPrefix = "rpt_"
+	ApiKeyHeader = "X-API-Key"
+
+	AuthMethodJWT    = "jwt"
+	AuthMethodApiKey = "api_key"
+
+	// Recording every use would turn each report request into a write.
+	apiKeyLastUsedInterval = time.Minute
+)
+
+var (
+	errInvalidApiKey   = fmt.Errorf("Invalid API key")
+	errApiKeyIPBlocked = fmt.Errorf("API key not allowed from this address")
+)
+
+// ApiKeyScopes are the permissions a key may carry. Keys are for reading
+// reports; managing them stays with user sessions.
+var ApiKeyScopes = []string{structs.PermReportView, structs.PermReportRun, structs.PermReportExport}
+
+// ValidApiKeyScope reports whether scope may be given to an API key.
+func ValidApiKeyScope(scope string) bool {
+	for _, s := range ApiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateApiKey returns a new key as rpt_<prefix>_<secret>, with the
+// prefix and hash to store. The key itself is never stored.
+func GenerateApiKey() (key, prefix, hash string, err error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(id)
+	key = ApiKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, prefix, hashApiKey(key), nil
+}
+
+// The secret has 256 random bits, so a plain hash is enough; unlike a
+// password it can't be guessed from a dictionary.
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseAllowedIP checks an allow-list entry, a single address or a CIDR.
+func ParseAllowedIP(entry string) error {
+	if strings.Contains(entry, "/") {
+		_, _, err := net.ParseCIDR(entry)
+		return err
+	}
+	if net.ParseIP(entry) == nil {
+		return fmt.Errorf("invalid IP address %q", entry)
+	}
+	return nil
+}
+
+// SplitList splits a stored comma-separated column, dropping empty items.
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func ipAllowed(allowList, clientIP string) bool {
+	entries := SplitList(allowList)
+	if len(entries) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyFrom returns the key sent in X-API-Key or as a bearer token, or ""
+// if the request carries none.
+func apiKeyFrom(c *gin.Context) string {
+	if key := c.GetHeader(ApiKeyHeader); key != "" {
+		return key
+	}
+	if token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); strings.HasPrefix(token, ApiKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// authenticateApiKey resolves key to its stored record and owner, and the
+// owner's current permissions narrowed to what the key allows. A key
+// never grants more than its owner has right now.
+func authenticateApiKey(db *gorm.DB, key, clientIP string) (*structs.SysApiKey, *structs.SysUser, *Permissions, error) {
+	rest := strings.TrimPrefix(key, ApiKeyPrefix)
+	prefix, _, ok := strings.Cut(rest, "_")
+	if rest == key || !ok {
+		return nil, nil, nil, errInvalidApiKey
+	}
+
+	var record structs.SysApiKey
+	if err := db.Where("prefix = ?", prefix).First(&record).Error; err != nil {
+		return nil, nil, nil, errInvalidApiKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashApiKey(key)), []byte(record.Hash)) != 1 {
+		return nil, nil, nil, errInvalidApiKey
+	}
+	now := time.Now()
+	if record.RevokedAt != nil || (record.ExpiresAt != nil && now.After(*record.ExpiresAt)) {
+		return nil, nil, nil, errInvalidApiKey
+	}
+	if !ipAllowed(record.AllowedIPs, clientIP) {
+		return nil, nil, nil, errApiKeyIPBlocked
+	}
+
+	var owner structs.SysUser
+	if err := db.First(&owner, record.UserID).Error; err != nil {
+		return nil, nil, nil, errInvalidApiKey
+	}
+	_, perms, err := LoadPermissions(db, owner.Username)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if member, err := isSiteMember(db, owner.ID, record.SiteID); err != nil || !member {
+		return nil, nil, nil, ErrNotSiteMember
+	}
+
+	var reportIDs []uint
+	for _, id := range SplitList(record.ReportIDs) {
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+			reportIDs = append(reportIDs, uint(n))
+		}
+	}
+	perms = perms.Restrict(SplitList(record.Scopes), reportIDs)
+
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) > apiKeyLastUsedInterval {
+		err := db.Model(&record).UpdateColumns(map[string]interface{}{"last_used_at": now, "last_used_ip": clientIP}).Error
+		if err != nil {
+			log.Printf("error recording use of API key %s: %v", record.Prefix, err)
+		}
+	}
+	return &record, &owner, perms, nil
+}
+
+// authenticateApiKeyRequest is AuthenticateJWT for requests that carry an
+// API key instead of a token.
+func authenticateApiKeyRequest(c *gin.Context, db *gorm.DB, key string) {
+	record, owner, perms, err := authenticateApiKey(db, key, c.ClientIP())
+	switch err {
+	case nil:
+	case ErrUserDisabled:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "User is disabled"})
+		return
+	case ErrNotSiteMember:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not a member of this site"})
+		return
+	case errApiKeyIPBlocked:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	default:
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": errInvalidApiKey.Error()})
+		return
+	}
+
+	c.Set("username", owner.Username)
+	c.Set("site_id", record.SiteID)
+	c.Set("permissions", perms)
+	c.Set("auth_method", AuthMethodApiKey)
+	c.Set("api_key_id", record.ID)
+	c.Next()
+}
+
+// RequireUserSession rejects requests authenticated with an API key, for
+// routes that act on the account itself: keys must not mint tokens, manage
+// keys or reach the admin API even if their owner could.
+func RequireUserSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("auth_method") == AuthMethodApiKey {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not available with an API key"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newApiKey stores a key of owner with the given scopes and returns it.
+func newApiKey(t *testing.T, db *gorm.DB, owner structs.SysUser, scopes string, edit func(*structs.SysApiKey)) string {
+	t.Helper()
+	key, prefix, hash, err := GenerateApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := structs.SysApiKey{Prefix: prefix, Hash: hash, Name: "test", UserID: owner.ID, Scopes: scopes}
+	if edit != nil {
+		edit(&record)
+	}
+	if err := db.Create(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAuthenticateApiKey(t *testing.T) {
+	db := newTestDB(t)
+	owner := structs.SysUser{Username: "alice", Role: structs.RoleAdmin, Active: true}
+	db.Create(&owner)
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	valid := newApiKey(t, db, owner, structs.PermReportRun, nil)
+	expired := newApiKey(t, db, owner, structs.PermReportRun, func(k *structs.SysApiKey) { k.ExpiresAt = &past })
+	notExpired := newApiKey(t, db, owner, structs.PermReportRun, func(k *structs.SysApiKey) { k.ExpiresAt = &future })
+	revoked := newApiKey(t, db, owner, structs.PermReportRun, func(k *structs.SysApiKey) { k.RevokedAt = &past })
+	restricted := newApiKey(t, db, owner, structs.PermReportRun, func(k *structs.SysApiKey) { k.AllowedIPs = "10.0.0.0/8, 192.168.1.5" })
+	// Right prefix, wrong secret.
+	forged := valid[:len(valid)-4] + "AAAA"
+
+	tests := []struct {
+		name string
+		key  string
+		ip   string
+		want error
+	}{
+		{"valid", valid, "203.0.113.9", nil},
+		{"wrong secret", forged, "203.0.113.9", errInvalidApiKey},
+		{"unknown prefix", ApiKeyPrefix + "000000000000_secret", "203.0.113.9", errInvalidApiKey},
+		{"no prefix", "rpt_secret", "203.0.113.9", errInvalidApiKey},
+		{"not a key", "secret", "203.0.113.9", errInvalidApiKey},
+		{"expired", expired, "203.0.113.9", errInvalidApiKey},
+		{"not yet expired", notExpired, "203.0.113.9", nil},
+		{"revoked", revoked, "203.0.113.9", errInvalidApiKey},
+		{"allowed network", restricted, "10.1.2.3", nil},
+		{"allowed address", restricted, "192.168.1.5", nil},
+		{"blocked address", restricted, "192.168.1.6", errApiKeyIPBlocked},
+		{"unparsable address", restricted, "", errApiKeyIPBlocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := authenticateApiKey(db, tt.key, tt.ip)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	var record structs.SysApiKey
+	db.Where("hash = ?", hashApiKey(valid)).First(&record)
+	if record.LastUsedAt == nil || record.LastUsedIP != "203.0.113.9" {
+		t.Errorf("use not recorded: %+v", record)
+	}
+
+	db.Model(&owner).Update("active", false)
+	if _, _, _, err := authenticateApiKey(db, valid, "203.0.113.9"); err != ErrUserDisabled {
+		t.Fatalf("disabled owner: got %v, want ErrUserDisabled", err)
+	}
+}
+
+func TestReadOnlyApiKeyCantExport(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.AutoMigrate(&structs.SysMetaRpt{}); err != nil {
+		t.Fatal(err)
+	}
+	// The owner could export; the key must not.
+	owner := structs.SysUser{Username: "alice", Role: structs.RoleAdmin, Active: true}
+	db.Create(&owner)
+	report := structs.SysMetaRpt{Name: "sales", Module: "sales"}
+	db.Create(&report)
+	readOnly := newApiKey(t, db, owner, structs.PermReportView+","+structs.PermReportRun, nil)
+	exporter := newApiKey(t, db, owner, structs.PermReportExport, nil)
+
+	router := gin.New()
+	router.Use(AuthenticateJWT(db))
+	router.GET("/report/:id/:clientid/excel", RequireReportPermission(db, structs.PermReportExport), func(c *gin.Context) {
+		c.Status(http.StatusAccepted)
+	})
+	export := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/report/"+strconv.Itoa(int(report.ID))+"/c1/excel", nil)
+		req.Header.Set(ApiKeyHeader, key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := export(readOnly); code != http.StatusForbidden {
+		t.Fatalf("read-only key: got %d, want 403", code)
+	}
+	if code := export(exporter); code != http.StatusAccepted {
+		t.Fatalf("export key: got %d, want 202", code)
+	}
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"fmt"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	ErrInvalidCredentials = fmt.Errorf("Invalid username or password")
+	// ErrAuthUnavailable means a backend couldn't answer, as opposed to
+	// rejecting the credentials.
+	ErrAuthUnavailable = fmt.Errorf("Authentication backend unavailable")
+	// errUnknownUser lets the chain move on to the next authenticator.
+	errUnknownUser = fmt.Errorf("unknown user")
+)
+
+// Authenticator checks a username and password against one backend and
+// returns the matching sys_user, creating or updating it if the backend
+// owns the account. It returns errUnknownUser for accounts it doesn't
+// handle and ErrInvalidCredentials for a wrong password.
+type Authenticator interface {
+	Name() string
+	Authenticate(db *gorm.DB, username, password string) (*structs.SysUser, error)
+}
+
+var authenticators = []Authenticator{LocalAuthenticator{}}
+
+// InitAuthenticators sets up the chain Login tries in order from
+// AUTH_BACKENDS, e.g. "local,ldap". The default is local only.
+func InitAuthenticators() error {
+	loadEnv()
+	backends := SplitList(os.Getenv("AUTH_BACKENDS"))
+	if len(backends) == 0 {
+		return nil
+	}
+
+	var chain []Authenticator
+	for _, backend := range backends {
+		switch backend {
+		case structs.AuthSourceLocal:
+			chain = append(chain, LocalAuthenticator{})
+		case structs.AuthSourceLDAP:
+			config, err := ldapConfigFromEnv()
+			if err != nil {
+				return err
+			}
+			chain = append(chain, NewLDAPAuthenticator(config))
+		default:
+			return fmt.Errorf("unknown authentication backend %q", backend)
+		}
+	}
+	authenticators = chain
+	return nil
+}
+
+// authenticate runs the chain until an authenticator claims the account.
+// The first one to claim it decides; a wrong local password doesn't fall
+// through to the directory.
+func authenticate(db *gorm.DB, chain []Authenticator, username, password string) (*structs.SysUser, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	for _, authenticator := range chain {
+		user, err := authenticator.Authenticate(db, username, password)
+		if err == errUnknownUser {
+			continue
+		}
+		if err != nil && err != ErrInvalidCredentials {
+			log.Printf("%s authentication of %s failed: %v", authenticator.Name(), username, err)
+			return nil, ErrAuthUnavailable
+		}
+		return user, err
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// LocalAuthenticator checks the password hash stored in sys_user. It skips
+// accounts another backend owns.
+type LocalAuthenticator struct{}
+
+func (LocalAuthenticator) Name() string {
+	return structs.AuthSourceLocal
+}
+
+func (LocalAuthenticator) Authenticate(db *gorm.DB, username, password string) (*structs.SysUser, error) {
+	var user structs.SysUser
+	err := db.Where("username = ?", username).First(&user).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errUnknownUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.AuthSource != "" && user.AuthSource != structs.AuthSourceLocal {
+		return nil, errUnknownUser
+	}
+	if strings.TrimSpace(user.Password) == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	ok, needsRehash := VerifyPassword(password, user.Password)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if needsRehash {
+		rehashPassword(db, &user, password)
+	}
+	return &user, nil
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"go-report-management/utils"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultChartCategories = 50
+	MaxChartCategories     = 500
+)
+
+// ErrNoChart means the report doesn't exist or has no chart definition.
+var ErrNoChart = fmt.Errorf("report has no chart definition")
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_ ]*$`)
+
+var aggregateFunctions = map[string]string{
+	"sum":   "SUM",
+	"avg":   "AVG",
+	"count": "COUNT",
+	"min":   "MIN",
+	"max":   "MAX",
+}
+
+type ChartDataset struct {
+	Label string        `json:"label"`
+	Data  []interface{} `json:"data"`
+}
+
+type ChartData struct {
+	Type      string         `json:"type"`
+	Title     string         `json:"title"`
+	Labels    []interface{}  `json:"labels"`
+	Datasets  []ChartDataset `json:"datasets"`
+	Truncated bool           `json:"truncated"`
+}
+
+func GetChartData(db *sql.DB, scope QueryScope, reportID int, filters map[string]string, maxCategories int) (*ChartData, error) {
+	spec, err := GetChartSpecByID(db, reportID)
+	if err == sql.ErrNoRows || (err == nil && spec == nil) {
+		return nil, ErrNoChart
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting chart definition: %v", err)
+	}
+
+	rq, err := GetQueryByID(db, reportID, scope)
+	if err != nil {
+		return nil, fmt.Errorf("error getting query by ID: %v", err)
+	}
+
+	category, err := quoteIdentifier(spec.Category)
+	if err != nil {
+		return nil, err
+	}
+
+	selects := []string{category}
+	data := &ChartData{Type: spec.Type, Title: spec.Title, Labels: []interface{}{}}
+	for _, series := range spec.Series {
+		column, err := quoteIdentifier(series.Column)
+		if err != nil {
+			return nil, err
+		}
+		aggregate := strings.ToLower(series.Aggregate)
+		if aggregate == "" {
+			aggregate = "sum"
+		}
+		fn, ok := aggregateFunctions[aggregate]
+		if !ok {
+			return nil, fmt.Errorf("unsupported aggregate function: %s", series.Aggregate)
+		}
+		selects = append(selects, fmt.Sprintf("%s(%s)", fn, column))
+
+		label := series.Name
+		if label == "" {
+			label = series.Column
+		}
+		data.Datasets = append(data.Datasets, ChartDataset{Label: label, Data: []interface{}{}})
+	}
+
+	if maxCategories < 1 || maxCategories > MaxChartCategories {
+		maxCategories = DefaultChartCategories
+	}
+
+	havingClause, err := buildHavingClause(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	chartQuery := fmt.Sprintf("SELECT %s FROM (%s) AS chart_data GROUP BY %s ORDER BY %s LIMIT %d",
+		strings.Join(selects, ", "), reportSubquery(rq, havingClause), category, category, maxCategories+1)
+
+	rows, err := db.Query(chartQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error executing chart query: %v", err)
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		if len(data.Labels) == maxCategories {
+			data.Truncated = true
+			break
+		}
+
+		values := make([]interface{}, len(colTypes))
+		pointers := make([]interface{}, len(colTypes))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		for i, colType := range colTypes {
+			value, err := utils.ConvertColumnValue(values[i], colType.DatabaseTypeName())
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				data.Labels = append(data.Labels, value)
+			} else {
+				data.Datasets[i-1].Data = append(data.Datasets[i-1].Data, value)
+			}
+		}
+	}
+
+	return data, rows.Err()
+}
+
+func quoteIdentifier(name string) (string, error) {
+	if !identifierPattern.MatchString(name) {
+		return "", fmt.Errorf("invalid column name: %q", name)
+	}
+	return "`" + name + "`", nil
+}
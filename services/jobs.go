@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/google/uuid"
+	"go-report-management/events"
+	"sort"
+	"sync"
+	"time"
+)
+
+// finishedJobRetention is how long a finished job stays visible to
+// ListJobs and subscribers.
+const finishedJobRetention = time.Hour
+
+var (
+	ErrJobNotFound   = fmt.Errorf("job not found")
+	ErrJobFinished   = fmt.Errorf("job already finished")
+	ErrNotJobOwner   = fmt.Errorf("only the job owner can do that")
+	ErrJobRowsDiffer = fmt.Errorf("this job covers rows you can't read")
+)
+
+type Job struct {
+	ID        string
+	ReportID  int
+	ClientID  string
+	Owner     string
+	CreatedAt time.Time
+
+	scope  QueryScope
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	status      string
+	percent     float64
+	finishedAt  time.Time
+	subscribers map[string]bool
+}
+
+type JobInfo struct {
+	ID        string    `json:"job_id"`
+	ReportID  int       `json:"report_id"`
+	Owner     string    `json:"owner"`
+	Status    string    `json:"status"`
+	Percent   float64   `json:"percent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var jobs = struct {
+	sync.Mutex
+	byID map[string]*Job
+}{byID: make(map[string]*Job)}
+
+// NewJob registers a job that runs the report for scope; scope's user owns
+// it.
+func NewJob(reportID int, clientID string, scope QueryScope) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:          uuid.New().String(),
+		ReportID:    reportID,
+		ClientID:    clientID,
+		Owner:       scope.Username,
+		CreatedAt:   time.Now(),
+		scope:       scope,
+		ctx:         ctx,
+		cancel:      cancel,
+		status:      events.MessageQueued,
+		subscribers: make(map[string]bool),
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	for id, old := range jobs.byID {
+		if old.expired() {
+			delete(jobs.byID, id)
+		}
+	}
+	jobs.byID[job.ID] = job
+	return job
+}
+
+func GetJob(id string) (*Job, error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	job, ok := jobs.byID[id]
+	if !ok || job.expired() {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// ListJobs returns the jobs user owns or subscribes to, newest first.
+func ListJobs(user string) []JobInfo {
+	jobs.Lock()
+	list := []JobInfo{}
+	for _, job := range jobs.byID {
+		if job.expired() {
+			continue
+		}
+		job.mu.Lock()
+		if job.Owner == user || job.subscribers[user] {
+			list = append(list, job.infoLocked())
+		}
+		job.mu.Unlock()
+	}
+	jobs.Unlock()
+
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.After(list[k].CreatedAt) })
+	return list
+}
+
+// CancelJob stops a running job. Only its owner may cancel it.
+func CancelJob(id, user string) error {
+	job, err := GetJob(id)
+	if err != nil {
+		return err
+	}
+	if job.Owner != user {
+		return ErrNotJobOwner
+	}
+	if job.Finished() {
+		return ErrJobFinished
+	}
+	job.cancel()
+	return nil
+}
+
+// CheckSubscriber returns an error unless viewer would read exactly the
+// rows the job exports: the same site and the same row policies once bound
+// to each user. The job's progress and file describe the owner's rows.
+func (j *Job) CheckSubscriber(db *sql.DB, viewer QueryScope) error {
+	if viewer.Username == j.Owner && viewer.SiteID == j.scope.SiteID {
+		return nil
+	}
+	if viewer.SiteID != j.scope.SiteID {
+		return ErrJobRowsDiffer
+	}
+	ownerPolicies, err := loadRowPolicies(db, j.ReportID, j.scope)
+	if err != nil {
+		return err
+	}
+	viewerPolicies, err := loadRowPolicies(db, j.ReportID, viewer)
+	if err != nil {
+		return err
+	}
+	if len(ownerPolicies) != len(viewerPolicies) {
+		return ErrJobRowsDiffer
+	}
+	for i := range ownerPolicies {
+		if ownerPolicies[i] != viewerPolicies[i] {
+			return ErrJobRowsDiffer
+		}
+	}
+	return nil
+}
+
+// Subscribe makes user receive job's events as well as the owner.
+func (j *Job) Subscribe(user string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if user != j.Owner {
+		j.subscribers[user] = true
+	}
+}
+
+func (j *Job) Unsubscribe(user string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.subscribers, user)
+}
+
+func (j *Job) Info() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.infoLocked()
+}
+
+func (j *Job) infoLocked() JobInfo {
+	return JobInfo{
+		ID:        j.ID,
+		ReportID:  j.ReportID,
+		Owner:     j.Owner,
+		Status:    j.status,
+		Percent:   j.percent,
+		CreatedAt: j.CreatedAt,
+	}
+}
+
+func (j *Job) Finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero()
+}
+
+func (j *Job) expired() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero() && time.Since(j.finishedAt) > finishedJobRetention
+}
+
+func (j *Job) Queued() {
+	j.notify(events.Message{Type: events.MessageQueued})
+}
+
+func (j *Job) completed(url string, rows int) {
+	j.notify(events.Message{Type: events.MessageCompleted, Percent: 100, RowsDone: rows, RowsTotal: rows, URL: url})
+}
+
+func (j *Job) failed(err error) {
+	j.notify(events.Message{Type: events.MessageFailed, Error: err.Error()})
+}
+
+func (j *Job) cancelled() {
+	j.notify(events.Message{Type: events.MessageCancelled})
+}
+
+// notify records msg as the job's latest state and publishes it to the
+// owner and every subscriber. Terminal messages release the job's context.
+func (j *Job) notify(msg events.Message) {
+	msg.JobID = j.ID
+	msg.ReportID = j.ReportID
+
+	j.mu.Lock()
+	if !j.finishedAt.IsZero() {
+		j.mu.Unlock()
+		return
+	}
+	j.status = msg.Type
+	if msg.Percent > 0 {
+		j.percent = msg.Percent
+	}
+	terminal := msg.Type == events.MessageCompleted || msg.Type == events.MessageFailed || msg.Type == events.MessageCancelled
+	if terminal {
+		j.finishedAt = time.Now()
+	}
+	recipients := []string{j.Owner}
+	for user := range j.subscribers {
+		recipients = append(recipients, user)
+	}
+	j.mu.Unlock()
+
+	for _, user := range recipients {
+		events.Publish(user, msg)
+	}
+	if terminal {
+		j.cancel()
+	}
+}
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// LDAPConfig describes the directory LDAPAuthenticator binds against. URL
+// may be ldap:// or ldaps://; StartTLS upgrades a plain ldap:// connection.
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	// RootCAs verifies the server certificate; nil means the system pool.
+	RootCAs *x509.CertPool
+
+	// BindDN and BindPassword are the service account used to find the
+	// user's entry. Without BindDN the search binds anonymously.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the entry; %s is the escaped username, e.g.
+	// (sAMAccountName=%s) for Active Directory.
+	UserFilter string
+
+	EmailAttribute string
+	NameAttribute  string
+	GroupAttribute string
+
+	// GroupRoles maps group DNs to what membership gives: "admin" or
+	// "user" set the user's role, any other value is the name of a
+	// sys_group the user is kept a member of.
+	GroupRoles map[string]string
+}
+
+// LDAPAuthenticator authenticates by binding as the user's directory entry.
+// Directory users are provisioned on first login and their email, name,
+// role and mapped groups are refreshed on every login.
+type LDAPAuthenticator struct {
+	config LDAPConfig
+}
+
+func NewLDAPAuthenticator(config LDAPConfig) *LDAPAuthenticator {
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.NameAttribute == "" {
+		config.NameAttribute = "displayName"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	return &LDAPAuthenticator{config: config}
+}
+
+// ldapConfigFromEnv reads LDAP_URL, LDAP_START_TLS, LDAP_INSECURE_SKIP_VERIFY,
+// LDAP_CA_CERT, LDAP_BIND_DN, LDAP_BIND_PASSWORD, LDAP_BASE_DN,
+// LDAP_USER_FILTER, the LDAP_*_ATTRIBUTE overrides and LDAP_GROUP_ROLES,
+// which lists "<group DN>=><role or group>" pairs separated by ";".
+func ldapConfigFromEnv() (LDAPConfig, error) {
+	config := LDAPConfig{
+		URL:            os.Getenv("LDAP_URL"),
+		BindDN:         os.Getenv("LDAP_BIND_DN"),
+		BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:         os.Getenv("LDAP_BASE_DN"),
+		UserFilter:     os.Getenv("LDAP_USER_FILTER"),
+		EmailAttribute: os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		NameAttribute:  os.Getenv("LDAP_NAME_ATTRIBUTE"),
+		GroupAttribute: os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+		GroupRoles:     map[string]string{},
+	}
+	if config.URL == "" || config.BaseDN == "" {
+		return config, fmt.Errorf("LDAP_URL and LDAP_BASE_DN are required")
+	}
+	config.StartTLS, _ = strconv.ParseBool(os.Getenv("LDAP_START_TLS"))
+	config.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv("LDAP_INSECURE_SKIP_VERIFY"))
+
+	if path := os.Getenv("LDAP_CA_CERT"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return config, fmt.Errorf("no certificates in %s", path)
+		}
+	}
+
+	for _, mapping := range strings.Split(os.Getenv("LDAP_GROUP_ROLES"), ";") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+		dn, target, ok := strings.Cut(mapping, "=>")
+		if !ok || strings.TrimSpace(dn) == "" || strings.TrimSpace(target) == "" {
+			return config, fmt.Errorf("invalid LDAP_GROUP_ROLES entry %q", mapping)
+		}
+		config.GroupRoles[normalizeDN(dn)] = strings.TrimSpace(target)
+	}
+	return config, nil
+}
+
+func (a *LDAPAuthenticator) Name() string {
+	return structs.AuthSourceLDAP
+}
+
+func (a *LDAPAuthenticator) Authenticate(db *gorm.DB, username, password string) (*structs.SysUser, error) {
+	var user structs.SysUser
+	err := db.Where("username = ?", username).First(&user).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	exists := err == nil
+	// A directory entry with the same name must not take over a local or
+	// single sign-on account.
+	if exists && user.AuthSource != structs.AuthSourceLDAP {
+		return nil, errUnknownUser
+	}
+
+	entry, err := a.bind(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	email := entry.GetAttributeValue(a.config.EmailAttribute)
+	displayName := entry.GetAttributeValue(a.config.NameAttribute)
+	role, groups := a.mapGroups(entry.GetAttributeValues(a.config.GroupAttribute))
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if exists {
+			updates := map[string]interface{}{"email": email, "display_name": displayName}
+			if role != "" {
+				updates["role"] = role
+			}
+			if err := tx.Model(&user).Updates(updates).Error; err != nil {
+				return err
+			}
+		} else {
+			user = structs.SysUser{
+				Username:    username,
+				Email:       email,
+				DisplayName: displayName,
+				Role:        structs.RoleUser,
+				Active:      true,
+				AuthSource:  structs.AuthSourceLDAP,
+			}
+			if role != "" {
+				user.Role = role
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		}
+		return a.syncGroups(tx, &user, groups)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		log.Printf("provisioned user %s from LDAP entry %s", username, entry.DN)
+	}
+	return &user, nil
+}
+
+// bind finds the user's entry with the service account and then binds as
+// that entry with password.
+func (a *LDAPAuthenticator) bind(username, password string) (*ldap.Entry, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if a.config.BindDN != "" {
+		err = conn.Bind(a.config.BindDN, a.config.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("service bind: %v", err)
+	}
+
+	attributes := []string{"dn", a.config.EmailAttribute, a.config.NameAttribute, a.config.GroupAttribute}
+	search := ldap.NewSearchRequest(a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)), attributes, nil)
+	result, err := conn.Search(search)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, errUnknownUser
+	}
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("search: %v", err)
+	}
+	if result == nil || len(result.Entries) == 0 {
+		return nil, errUnknownUser
+	}
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("filter matches more than one entry for %s", username)
+	}
+
+	// The password is never empty here; an empty one would be an
+	// unauthenticated bind that many servers accept.
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("user bind: %v", err)
+	}
+	return entry, nil
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{RootCAs: a.config.RootCAs, InsecureSkipVerify: a.config.InsecureSkipVerify}
+	if u, err := ldapHost(a.config.URL); err == nil {
+		tlsConfig.ServerName = u
+	}
+
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if a.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+func ldapHost(rawURL string) (string, error) {
+	_, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return "", fmt.Errorf("invalid LDAP URL %q", rawURL)
+	}
+	host, _, _ := strings.Cut(rest, "/")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h, nil
+	}
+	return host, nil
+}
+
+// mapGroups turns the entry's group DNs into a role and the sys_group names
+// the user belongs in. role is "" when no mapping is configured, leaving
+// the stored role alone; otherwise admin wins over user.
+func (a *LDAPAuthenticator) mapGroups(memberOf []string) (role string, groups []string) {
+	if len(a.config.GroupRoles) == 0 {
+		return "", nil
+	}
+	role = structs.RoleUser
+	for _, dn := range memberOf {
+		switch target := a.config.GroupRoles[normalizeDN(dn)]; target {
+		case "":
+		case structs.RoleAdmin:
+			role = structs.RoleAdmin
+		case structs.RoleUser:
+		default:
+			groups = append(groups, target)
+		}
+	}
+	return role, groups
+}
+
+// syncGroups makes the user's membership of every mapped sys_group match
+// groups. Groups nobody maps to are left alone, so memberships added by an
+// admin survive.
+func (a *LDAPAuthenticator) syncGroups(tx *gorm.DB, user *structs.SysUser, groups []string) error {
+	var managed []string
+	for _, target := range a.config.GroupRoles {
+		if target != structs.RoleAdmin && target != structs.RoleUser {
+			managed = append(managed, target)
+		}
+	}
+	if len(managed) == 0 {
+		return nil
+	}
+
+	var known []structs.SysGroup
+	if err := tx.Where("name IN ?", managed).Find(&known).Error; err != nil {
+		return err
+	}
+	member := map[string]bool{}
+	for _, name := range groups {
+		member[name] = true
+	}
+	for _, group := range known {
+		membership := structs.SysGroupMember{GroupID: group.ID, UserID: user.ID}
+		var err error
+		if member[group.Name] {
+			err = tx.Save(&membership).Error
+		} else {
+			err = tx.Delete(&membership).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeDN makes group DNs from the directory and the configuration
+// comparable; directories differ in case and spacing around separators.
+func normalizeDN(dn string) string {
+	if parsed, err := ldap.ParseDN(strings.TrimSpace(dn)); err == nil {
+		var rdns []string
+		for _, rdn := range parsed.RDNs {
+			var parts []string
+			for _, attr := range rdn.Attributes {
+				parts = append(parts, strings.ToLower(attr.Type)+"="+strings.ToLower(attr.Value))
+			}
+			rdns = append(rdns, strings.Join(parts, "+"))
+		}
+		return strings.Join(rdns, ",")
+	}
+	return strings.ToLower(strings.TrimSpace(dn))
+}
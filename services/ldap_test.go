@@ -0,0 +1,209 @@
+package services
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"testing"
+)
+
+const (
+	adminsDN  = "cn=admins,ou=groups,dc=example,dc=org"
+	financeDN = "cn=finance,ou=groups,dc=example,dc=org"
+)
+
+// startDirectory runs an in-process LDAPS server holding users and returns
+// an authenticator configured against it. The test directory matches
+// filters on the entry DN, hence (cn=%s).
+func startDirectory(t *testing.T, users ...*gldap.Entry) (*testdirectory.Directory, *LDAPAuthenticator) {
+	t.Helper()
+	directory := testdirectory.Start(t, testdirectory.WithDefaults(t, &testdirectory.Defaults{AllowAnonymousBind: true}))
+	directory.SetUsers(users...)
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(directory.Cert())) {
+		t.Fatal("no directory CA certificate")
+	}
+	return directory, NewLDAPAuthenticator(LDAPConfig{
+		URL:            fmt.Sprintf("ldaps://%s:%d", directory.Host(), directory.Port()),
+		RootCAs:        roots,
+		BaseDN:         "ou=people,dc=example,dc=org",
+		UserFilter:     "(cn=%s)",
+		EmailAttribute: "email",
+		NameAttribute:  "name",
+		GroupRoles: map[string]string{
+			normalizeDN(adminsDN):  structs.RoleAdmin,
+			normalizeDN(financeDN): "finance",
+		},
+	})
+}
+
+// directoryUser is a test directory entry with password "password".
+func directoryUser(t *testing.T, name string, memberOf ...string) *gldap.Entry {
+	return testdirectory.NewUsers(t, []string{name}, testdirectory.WithMembersOf(t, memberOf...))[0]
+}
+
+func groupMembers(t *testing.T, db *gorm.DB, userID uint) []string {
+	t.Helper()
+	var names []string
+	err := db.Model(&structs.SysGroup{}).
+		Joins("JOIN sys_group_member ON sys_group_member.group_id = sys_group.id").
+		Where("sys_group_member.user_id = ?", userID).
+		Order("name").Pluck("name", &names).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestLDAPProvisionsUserFromDirectory(t *testing.T) {
+	db := newTestDB(t)
+	db.Create(&structs.SysGroup{Name: "finance"})
+	_, ldapAuth := startDirectory(t, directoryUser(t, "alice", financeDN))
+
+	user, err := ldapAuth.Authenticate(db, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.AuthSource != structs.AuthSourceLDAP || user.Email != "alice@example.com" || user.DisplayName != "alice" || user.Role != structs.RoleUser || !user.Active {
+		t.Fatalf("unexpected provisioned user %+v", user)
+	}
+	if groups := groupMembers(t, db, user.ID); len(groups) != 1 || groups[0] != "finance" {
+		t.Fatalf("got groups %v, want [finance]", groups)
+	}
+}
+
+func TestLDAPBindFailures(t *testing.T) {
+	db := newTestDB(t)
+	_, ldapAuth := startDirectory(t, directoryUser(t, "alice"))
+
+	if _, err := ldapAuth.Authenticate(db, "alice", "wrong"); err != ErrInvalidCredentials {
+		t.Fatalf("wrong password: got %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := ldapAuth.Authenticate(db, "mallory", "password"); err != errUnknownUser {
+		t.Fatalf("unknown user: got %v, want errUnknownUser", err)
+	}
+	// The directory allows anonymous binds; an empty password must not
+	// become one.
+	if _, err := authenticate(db, []Authenticator{ldapAuth}, "alice", ""); err != ErrInvalidCredentials {
+		t.Fatalf("empty password: got %v, want ErrInvalidCredentials", err)
+	}
+	var count int64
+	db.Model(&structs.SysUser{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("failed binds provisioned %d users", count)
+	}
+}
+
+func TestLDAPUnreachableDirectory(t *testing.T) {
+	db := newTestDB(t)
+	ldapAuth := NewLDAPAuthenticator(LDAPConfig{
+		URL:    fmt.Sprintf("ldap://localhost:%d", testdirectory.FreePort(t)),
+		BaseDN: "ou=people,dc=example,dc=org",
+	})
+	chain := []Authenticator{LocalAuthenticator{}, ldapAuth}
+	if _, err := authenticate(db, chain, "alice", "password"); err != ErrAuthUnavailable {
+		t.Fatalf("got %v, want ErrAuthUnavailable", err)
+	}
+}
+
+func TestLDAPMapsGroupsToRole(t *testing.T) {
+	_, ldapAuth := startDirectory(t)
+	tests := []struct {
+		name     string
+		memberOf []string
+		role     string
+		groups   []string
+	}{
+		{"no mapped groups", []string{"cn=other,ou=groups,dc=example,dc=org"}, structs.RoleUser, nil},
+		{"admin group", []string{adminsDN}, structs.RoleAdmin, nil},
+		{"case and spacing differ", []string{"CN=Admins, OU=Groups, DC=example, DC=org"}, structs.RoleAdmin, nil},
+		{"sys_group", []string{financeDN}, structs.RoleUser, []string{"finance"}},
+		{"admin and sys_group", []string{financeDN, adminsDN}, structs.RoleAdmin, []string{"finance"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, groups := ldapAuth.mapGroups(tt.memberOf)
+			if role != tt.role || fmt.Sprint(groups) != fmt.Sprint(tt.groups) {
+				t.Fatalf("got %q %v, want %q %v", role, groups, tt.role, tt.groups)
+			}
+		})
+	}
+
+	unmapped := NewLDAPAuthenticator(LDAPConfig{})
+	if role, groups := unmapped.mapGroups([]string{adminsDN}); role != "" || groups != nil {
+		t.Fatalf("without GroupRoles got %q %v, want the stored role left alone", role, groups)
+	}
+}
+
+func TestLDAPSyncsRoleAndGroupsOnLogin(t *testing.T) {
+	db := newTestDB(t)
+	finance := structs.SysGroup{Name: "finance"}
+	auditors := structs.SysGroup{Name: "auditors"}
+	db.Create(&finance)
+	db.Create(&auditors)
+	directory, ldapAuth := startDirectory(t, directoryUser(t, "alice", adminsDN, financeDN))
+
+	user, err := ldapAuth.Authenticate(db, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != structs.RoleAdmin {
+		t.Fatalf("got role %q, want admin", user.Role)
+	}
+	// An admin adds alice to a group no directory group maps to.
+	db.Create(&structs.SysGroupMember{GroupID: auditors.ID, UserID: user.ID})
+
+	// alice leaves both directory groups.
+	directory.SetUsers(directoryUser(t, "alice"))
+	user, err = ldapAuth.Authenticate(db, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != structs.RoleUser {
+		t.Fatalf("got role %q after leaving admins, want user", user.Role)
+	}
+	if groups := groupMembers(t, db, user.ID); len(groups) != 1 || groups[0] != "auditors" {
+		t.Fatalf("got groups %v, want only the unmanaged [auditors]", groups)
+	}
+}
+
+func TestAuthenticatorChainOrder(t *testing.T) {
+	db := newTestDB(t)
+	_, ldapAuth := startDirectory(t, directoryUser(t, "alice"), directoryUser(t, "bob"))
+
+	// alice has a local account; the directory's alice is someone else.
+	hash, err := HashPassword("local-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := structs.SysUser{Username: "alice", Password: hash, Role: structs.RoleUser, Active: true, AuthSource: structs.AuthSourceLocal}
+	db.Create(&local)
+
+	for _, chain := range [][]Authenticator{{LocalAuthenticator{}, ldapAuth}, {ldapAuth, LocalAuthenticator{}}} {
+		name := chain[0].Name() + "," + chain[1].Name()
+		t.Run(name, func(t *testing.T) {
+			user, err := authenticate(db, chain, "alice", "local-secret")
+			if err != nil || user.ID != local.ID {
+				t.Fatalf("local password: got %+v %v, want the local account", user, err)
+			}
+			// The directory password must not open the local account,
+			// whichever backend is asked first.
+			if _, err := authenticate(db, chain, "alice", "password"); err != ErrInvalidCredentials {
+				t.Fatalf("directory password: got %v, want ErrInvalidCredentials", err)
+			}
+			// bob only exists in the directory.
+			user, err = authenticate(db, chain, "bob", "password")
+			if err != nil || user.AuthSource != structs.AuthSourceLDAP {
+				t.Fatalf("directory user: got %+v %v", user, err)
+			}
+			// and once provisioned, the local backend leaves him alone.
+			if _, err := authenticate(db, []Authenticator{LocalAuthenticator{}}, "bob", "password"); err != ErrInvalidCredentials {
+				t.Fatalf("directory user through local only: got %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+}
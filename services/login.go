@@ -1,16 +1,15 @@
 package services
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"go-report-management/structs"
 	"gorm.io/gorm"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 )
@@ -22,8 +21,28 @@ func loadEnv() {
 	}
 }
 
+var ErrPasswordChangeRequired = fmt.Errorf("Password change required")
+
+// passwordChangeRoutes are the only routes a user who must change their
+// password can reach until they do. /logout takes the refresh token and
+// doesn't go through AuthenticateJWT.
+var passwordChangeRoutes = map[string]bool{
+	"/me/password": true,
+	"/logout/all":  true,
+}
+
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 24 * time.Hour
+)
+
 type Claims struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	SiteID    uint   `json:"site_id"`
+	TokenType string `json:"token_type"`
 	jwt.RegisteredClaims
 }
 
@@ -31,101 +50,129 @@ func Login(c *gin.Context, db *gorm.DB) {
 	type loginCreds struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		SiteID   uint   `json:"site_id"`
 	}
 
 	var creds loginCreds
-	var user structs.SysUser
 
 	if err := c.ShouldBindJSON(&creds); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
 		return
 	}
 
-	result := db.Where("username = ?", creds.Username).First(&user)
-
-	fmt.Println(result)
-	if result.Error != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+	user, err := authenticate(db, authenticators, creds.Username, creds.Password)
+	if err == ErrAuthUnavailable {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
 	}
-
-	if !checkPasswordHash(creds.Password, user.Password) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect password"})
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
-
-	tokenString, err := GenerateJWT(creds.Username)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+	if !user.Active {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is disabled"})
 		return
 	}
 
-	refreshToken, err := GenerateRefreshJWT(creds.Username)
+	session, err := startSession(db, user, creds.SiteID)
+	if err == ErrNotSiteMember {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this site"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate refresh token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": tokenString, "refresh_token": refreshToken})
+	c.JSON(http.StatusOK, session)
 }
 
-func checkPasswordHash(password, hash string) bool {
-	return fmt.Sprintf("%x", sha1.Sum([]byte(password))) == hash
-}
+// startSession issues the token pair for an authenticated user on
+// requestedSite, or their default site, and records the login. Every login
+// method ends here.
+func startSession(db *gorm.DB, user *structs.SysUser, requestedSite uint) (gin.H, error) {
+	siteID, err := resolveSite(db, user.ID, requestedSite)
+	if err == ErrNotSiteMember {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not load sites")
+	}
 
-func GenerateJWT(username string) (string, error) {
-	loadEnv()
-	jwtKey, jwtKeyExists := os.LookupEnv("jwtSecret")
-	if !jwtKeyExists {
-		log.Fatalf("JWT secret is missing")
+	tokenString, err := GenerateJWT(user.Username, siteID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate token")
 	}
 
-	expirationTime := time.Now().Add(15 * time.Minute)
-	claims := &Claims{
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			Issuer:    "your_app_name",
-		},
+	refreshToken, err := GenerateRefreshJWT(db, user, siteID, "")
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate refresh token")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtKey))
+	if err := db.Model(user).Update("last_login_at", time.Now()).Error; err != nil {
+		log.Printf("error storing last login for user %s: %v", user.Username, err)
+	}
 
-	return tokenString, err
+	return gin.H{"token": tokenString, "refresh_token": refreshToken, "site_id": siteID, "must_change_password": user.MustChangePassword}, nil
 }
 
-func GenerateRefreshJWT(username string) (string, error) {
-	loadEnv()
-	jwtKey, jwtKeyExists := os.LookupEnv("jwtSecret")
+// RequireAdmin lets the request through only if the authenticated user is
+// an active admin. It must run after AuthenticateJWT.
+func RequireAdmin(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user structs.SysUser
+		if err := db.Where("username = ?", c.GetString("username")).First(&user).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+			return
+		}
+		if !user.Active || user.Role != structs.RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
 
-	if !jwtKeyExists {
-		log.Fatalf("JWT secret is missing")
+// rehashPassword upgrades a legacy or outdated hash after a successful
+// login. Failing to store it is logged but doesn't fail the login.
+func rehashPassword(db *gorm.DB, user *structs.SysUser, password string) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		log.Printf("error rehashing password for user %s: %v", user.Username, err)
+		return
+	}
+	if err := db.Model(user).Update("password", hash).Error; err != nil {
+		log.Printf("error storing rehashed password for user %s: %v", user.Username, err)
 	}
-	expirationTime := time.Now().Add(24 * time.Hour)
+}
+
+func GenerateJWT(username string, siteID uint) (string, error) {
+	now := time.Now()
 	claims := &Claims{
-		Username: username,
+		Username:  username,
+		SiteID:    siteID,
+		TokenType: TokenTypeAccess,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ID:        uuid.New().String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
 			Issuer:    "your_app_name",
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtKey))
-
-	return tokenString, err
+	return keyRing.sign(claims)
 }
 
-func AuthenticateJWT() gin.HandlerFunc {
-	loadEnv()
-	jwtKey, jwtKeyExists := os.LookupEnv("jwtSecret")
-
-	if !jwtKeyExists {
-		log.Fatalf("JWT secret is missing")
-	}
-
+// AuthenticateJWT validates the bearer token, or the API key sent in its
+// place, and loads the principal's report permissions into the context for
+// the Require* middleware.
+func AuthenticateJWT(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if key := apiKeyFrom(c); key != "" {
+			authenticateApiKeyRequest(c, db, key)
+			return
+		}
+
 		const BearerSchema = "Bearer "
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -139,77 +186,85 @@ func AuthenticateJWT() gin.HandlerFunc {
 			return
 		}
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(jwtKey), nil
-		})
-
-		if err != nil || !token.Valid {
-			var message string
-			if err != nil {
-				message = err.Error()
-			} else {
-				message = "Invalid token"
-			}
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+		claims, err := parseClaims(tokenString, TokenTypeAccess)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		user, perms, err := checkPrincipal(db, claims)
+		if err == nil && user.MustChangePassword && !passwordChangeRoutes[c.FullPath()] {
+			err = ErrPasswordChangeRequired
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(AccessErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 
 		c.Set("username", claims.Username)
+		c.Set("site_id", claims.SiteID)
+		c.Set("permissions", perms)
+		c.Set("auth_method", AuthMethodJWT)
 		c.Next()
 	}
 }
 
-func RefreshToken(c *gin.Context) {
-	loadEnv()
-	jwtKey, jwtKeyExists := os.LookupEnv("jwtSecret")
-
-	if !jwtKeyExists {
-		log.Fatalf("JWT secret is missing")
+// AuthenticateAccessToken is the access token check of AuthenticateJWT, for
+// callers that receive the token outside the Authorization header, such as
+// the WebSocket and SSE handshakes. Neither is open to a user who must
+// change their password.
+func AuthenticateAccessToken(db *gorm.DB, tokenString string) (*Claims, *Permissions, error) {
+	claims, err := parseClaims(tokenString, TokenTypeAccess)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	var requestBody struct {
-		RefreshToken string `json:"refresh_token"`
+	user, perms, err := checkPrincipal(db, claims)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	if err := c.ShouldBindJSON(&requestBody); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
+	if user.MustChangePassword {
+		return nil, nil, ErrPasswordChangeRequired
 	}
+	return claims, perms, nil
+}
 
-	token, err := jwt.Parse(requestBody.RefreshToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtKey), nil
-	})
-
+// checkPrincipal loads the permissions of the user claims were issued to.
+// A valid signature isn't enough: the user may have been disabled, logged
+// out of all sessions or removed from the site since.
+func checkPrincipal(db *gorm.DB, claims *Claims) (*structs.SysUser, *Permissions, error) {
+	user, perms, err := LoadPermissions(db, claims.Username)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
-		return
+		return nil, nil, err
 	}
+	if sessionRevoked(user, claims) {
+		return nil, nil, ErrSessionRevoked
+	}
+	if member, err := isSiteMember(db, user.ID, claims.SiteID); err != nil || !member {
+		return nil, nil, ErrNotSiteMember
+	}
+	return user, perms, nil
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has expired"})
-			return
-		}
-
-		expirationTime := time.Now().Add(15 * time.Minute)
-		claims["exp"] = expirationTime.Unix()
-
-		newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := newToken.SignedString([]byte(jwtKey))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create token"})
-			return
-		}
+// AccessErrorStatus is the HTTP status for an AuthenticateAccessToken error.
+func AccessErrorStatus(err error) int {
+	if err == ErrUserDisabled || err == ErrNotSiteMember || err == ErrPasswordChangeRequired {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
 
-		c.JSON(http.StatusOK, gin.H{"token": tokenString})
-	} else {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+// parseClaims validates tokenString and requires it to be of tokenType, so
+// refresh tokens can't be used as access tokens or the other way round.
+func parseClaims(tokenString, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyRing.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	if claims.TokenType != tokenType {
+		return nil, fmt.Errorf("Invalid token type")
 	}
+	return claims, nil
 }
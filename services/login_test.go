@@ -0,0 +1,53 @@
+package services
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-report-management/structs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateJWTRequiresPasswordChange(t *testing.T) {
+	db := newTestDB(t)
+	useTestKeyRing(t, db)
+	user := structs.SysUser{Username: "alice", Role: structs.RoleUser, Active: true, MustChangePassword: true}
+	db.Create(&user)
+	token, err := GenerateJWT(user.Username, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(AuthenticateJWT(db))
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	router.GET("/reports", ok)
+	router.POST("/me/password", ok)
+	router.POST("/logout/all", ok)
+
+	request := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request(http.MethodGet, "/reports"); code != http.StatusForbidden {
+		t.Fatalf("GET /reports: got %d, want 403", code)
+	}
+	if code := request(http.MethodPost, "/me/password"); code != http.StatusNoContent {
+		t.Fatalf("POST /me/password: got %d, want 204", code)
+	}
+	if code := request(http.MethodPost, "/logout/all"); code != http.StatusNoContent {
+		t.Fatalf("POST /logout/all: got %d, want 204", code)
+	}
+	if _, _, err := AuthenticateAccessToken(db, token); err != ErrPasswordChangeRequired {
+		t.Fatalf("handshake: got %v, want ErrPasswordChangeRequired", err)
+	}
+
+	db.Model(&user).Update("must_change_password", false)
+	if code := request(http.MethodGet, "/reports"); code != http.StatusNoContent {
+		t.Fatalf("GET /reports after change: got %d, want 204", code)
+	}
+}
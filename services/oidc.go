@@ -0,0 +1,674 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateTTL         = 10 * time.Minute
+	oidcDiscoveryTTL     = time.Hour
+	oidcHTTPTimeout      = 10 * time.Second
+	oidcJWKSReloadPeriod = 10 * time.Second
+
+	// oidcStateCookie holds a hash of the pending state, tying the callback
+	// to the browser that started the login.
+	oidcStateCookie = "oidc_state"
+)
+
+// Asymmetric algorithms only: an HMAC ID token would be verified with the
+// client secret, which the provider doesn't need to prove anything.
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// OIDCConfig is the identity provider the app trusts for single sign-on.
+// Issuer may be any URL, a local mock provider included.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// AutoProvision creates users on their first login; otherwise only
+	// existing users can be linked.
+	AutoProvision bool
+	// PostLoginRedirect, if set, receives the token pair in its fragment
+	// instead of the callback answering with JSON.
+	PostLoginRedirect string
+}
+
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type oidcJSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	AuthorizedParty   string `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// OIDCProvider runs the authorization-code flow with PKCE against one
+// identity provider. Discovery and keys are fetched on first use and
+// cached, so the app starts even while the provider is down.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	keys         map[string]interface{}
+	keysLoadedAt time.Time
+}
+
+var (
+	oidcProvider     *OIDCProvider
+	oidcProviderOnce sync.Once
+)
+
+// NewOIDCProvider returns a provider for config.
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{config: config, client: &http.Client{Timeout: oidcHTTPTimeout}}
+}
+
+// currentOIDCProvider returns the provider configured through OIDC_ISSUER,
+// OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL, or nil if
+// single sign-on isn't configured.
+func currentOIDCProvider() *OIDCProvider {
+	oidcProviderOnce.Do(func() {
+		loadEnv()
+		if os.Getenv("OIDC_ISSUER") == "" || os.Getenv("OIDC_CLIENT_ID") == "" {
+			return
+		}
+		autoProvision := true
+		if b, err := strconv.ParseBool(os.Getenv("OIDC_AUTO_PROVISION")); err == nil {
+			autoProvision = b
+		}
+		oidcProvider = NewOIDCProvider(OIDCConfig{
+			Issuer:            os.Getenv("OIDC_ISSUER"),
+			ClientID:          os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:      os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:       os.Getenv("OIDC_REDIRECT_URL"),
+			Scopes:            strings.Fields(os.Getenv("OIDC_SCOPES")),
+			AutoProvision:     autoProvision,
+			PostLoginRedirect: os.Getenv("OIDC_POST_LOGIN_REDIRECT"),
+		})
+	})
+	return oidcProvider
+}
+
+// OIDCLogin starts single sign-on: it remembers a fresh state, nonce and
+// PKCE verifier and redirects to the provider. A cookie binds the state to
+// this browser. site_id in the query picks the site to log in to, as in
+// Login.
+func OIDCLogin(c *gin.Context, db *gorm.DB) {
+	provider := currentOIDCProvider()
+	if provider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+	siteID, _ := strconv.ParseUint(c.Query("site_id"), 10, 32)
+
+	authURL, state, err := provider.begin(db, uint(siteID))
+	if err != nil {
+		log.Printf("error starting OIDC login: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+	provider.setStateCookie(c, stateHash(state), int(oidcStateTTL/time.Second))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback finishes single sign-on: it redeems the code, validates the
+// ID token, finds or provisions the user and issues the app's token pair.
+func OIDCCallback(c *gin.Context, db *gorm.DB) {
+	provider := currentOIDCProvider()
+	if provider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+	if errCode := c.Query("error"); errCode != "" {
+		provider.fail(c, http.StatusUnauthorized, "Identity provider error: "+errCode)
+		return
+	}
+
+	// Without the cookie, a callback URL from someone else's login would
+	// sign this browser in as them.
+	cookie, err := c.Cookie(oidcStateCookie)
+	provider.setStateCookie(c, "", -1)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie), []byte(stateHash(c.Query("state")))) != 1 {
+		provider.fail(c, http.StatusUnauthorized, "Login was not started from this browser")
+		return
+	}
+
+	state, err := takeOIDCState(db, c.Query("state"))
+	if err != nil {
+		provider.fail(c, http.StatusUnauthorized, "Invalid or expired login state")
+		return
+	}
+	claims, err := provider.exchange(c.Query("code"), state)
+	if err != nil {
+		log.Printf("error completing OIDC login: %v", err)
+		provider.fail(c, http.StatusUnauthorized, "Could not verify identity")
+		return
+	}
+
+	user, err := provider.linkUser(db, claims)
+	if err != nil {
+		log.Printf("error linking OIDC subject %s: %v", claims.Subject, err)
+		provider.fail(c, http.StatusForbidden, err.Error())
+		return
+	}
+	if !user.Active {
+		provider.fail(c, http.StatusForbidden, "User is disabled")
+		return
+	}
+
+	session, err := startSession(db, user, state.SiteID)
+	if err == ErrNotSiteMember {
+		provider.fail(c, http.StatusForbidden, "Not a member of this site")
+		return
+	}
+	if err != nil {
+		provider.fail(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if provider.config.PostLoginRedirect == "" {
+		c.JSON(http.StatusOK, session)
+		return
+	}
+	fragment := url.Values{}
+	for key, value := range session {
+		fragment.Set(key, fmt.Sprint(value))
+	}
+	c.Redirect(http.StatusFound, provider.config.PostLoginRedirect+"#"+fragment.Encode())
+}
+
+// fail answers the callback with an error, through the post-login redirect
+// when there is one so the browser lands back in the app.
+func (p *OIDCProvider) fail(c *gin.Context, status int, message string) {
+	if p.config.PostLoginRedirect == "" {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+	c.Redirect(http.StatusFound, p.config.PostLoginRedirect+"#"+url.Values{"error": {message}}.Encode())
+}
+
+// setStateCookie stores value in the state cookie for maxAge seconds, or
+// deletes it when maxAge is negative. It is sent back only to the callback.
+func (p *OIDCProvider) setStateCookie(c *gin.Context, value string, maxAge int) {
+	path := "/"
+	secure := false
+	if redirect, err := url.Parse(p.config.RedirectURL); err == nil {
+		if redirect.Path != "" {
+			path = redirect.Path
+		}
+		secure = redirect.Scheme == "https"
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   secure,
+		HttpOnly: true,
+		// Lax still sends the cookie on the provider's top-level redirect
+		// back to the callback.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func stateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// begin stores a pending login and returns the provider's authorization
+// URL for it along with its state.
+func (p *OIDCProvider) begin(db *gorm.DB, siteID uint) (string, string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	var secrets [3]string
+	for i, size := range []int{32, 32, 64} {
+		if secrets[i], err = randomToken(size); err != nil {
+			return "", "", err
+		}
+	}
+	state := structs.SysOidcState{
+		State:        secrets[0],
+		Nonce:        secrets[1],
+		CodeVerifier: secrets[2],
+		SiteID:       siteID,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	}
+	if err := db.Create(&state).Error; err != nil {
+		return "", "", err
+	}
+	if err := db.Where("expires_at < ?", time.Now()).Delete(&structs.SysOidcState{}).Error; err != nil {
+		log.Printf("error pruning OIDC login states: %v", err)
+	}
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), state.State, nil
+}
+
+// takeOIDCState loads and deletes a pending login, so each state is
+// redeemed once even if two callbacks race.
+func takeOIDCState(db *gorm.DB, value string) (*structs.SysOidcState, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing state")
+	}
+	var state structs.SysOidcState
+	if err := db.First(&state, "state = ?", value).Error; err != nil {
+		return nil, err
+	}
+	result := db.Where("state = ?", value).Delete(&structs.SysOidcState{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 || time.Now().After(state.ExpiresAt) {
+		return nil, fmt.Errorf("state already used or expired")
+	}
+	return &state, nil
+}
+
+// exchange redeems code with the state's PKCE verifier and returns the
+// validated claims of the ID token.
+func (p *OIDCProvider) exchange(code string, state *structs.SysOidcState) (*oidcClaims, error) {
+	if code == "" {
+		return nil, fmt.Errorf("missing code")
+	}
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {state.CodeVerifier},
+	}
+	useBasicAuth := p.config.ClientSecret != "" && !supportsOnly(discovery.TokenAuthMethods, "client_secret_post")
+	if p.config.ClientSecret != "" && !useBasicAuth {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if useBasicAuth {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.doJSON(req, &tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+	return p.verifyIDToken(tokens.IDToken, state.Nonce)
+}
+
+// supportsOnly reports whether methods lists method and not
+// client_secret_basic, the default when discovery doesn't say.
+func supportsOnly(methods []string, method string) bool {
+	found := false
+	for _, m := range methods {
+		if m == "client_secret_basic" {
+			return false
+		}
+		if m == method {
+			found = true
+		}
+	}
+	return found
+}
+
+// verifyIDToken checks the token's signature against the provider's JWKS
+// and its issuer, audience, expiry and nonce.
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (*oidcClaims, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &oidcClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(oidcSigningMethods))
+	if _, err := parser.ParseWithClaims(raw, claims, p.keyFunc); err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(discovery.Issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, fmt.Errorf("token is not for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return nil, fmt.Errorf("unexpected authorized party %q", claims.AuthorizedParty)
+	}
+	if !claims.VerifyExpiresAt(time.Now(), true) {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	return claims, nil
+}
+
+func (p *OIDCProvider) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	stale := p.keys == nil || (p.keys[kid] == nil && time.Since(p.keysLoadedAt) > oidcJWKSReloadPeriod)
+	p.mu.Unlock()
+	// An unknown kid usually means the provider rotated its keys.
+	if stale {
+		if err := p.loadKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key := p.keys[kid]; key != nil {
+		return key, nil
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		discovery := p.discovery
+		p.mu.Unlock()
+		return discovery, nil
+	}
+	p.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, p.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var discovery oidcDiscovery
+	if err := p.doJSON(req, &discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %v", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", discovery.Issuer, p.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+
+	p.mu.Lock()
+	p.discovery = &discovery
+	p.discoveredAt = time.Now()
+	p.mu.Unlock()
+	return &discovery, nil
+}
+
+func (p *OIDCProvider) loadKeys() error {
+	discovery, err := p.discover()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []oidcJSONWebKey `json:"keys"`
+	}
+	if err := p.doJSON(req, &set); err != nil {
+		return fmt.Errorf("jwks: %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("skipping identity provider key %s: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysLoadedAt = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func (k oidcJSONWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (p *OIDCProvider) doJSON(req *http.Request, target interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, target)
+}
+
+// linkUser finds the user for the provider account: first by subject, then
+// by verified email, linking the subject to that user. Email only links
+// accounts that have nothing else to lose: admins, accounts with a local
+// password and directory accounts must be linked by an administrator
+// through the user's oidc_subject. Unknown accounts are provisioned as
+// plain users without a password when AutoProvision is on.
+func (p *OIDCProvider) linkUser(db *gorm.DB, claims *oidcClaims) (*structs.SysUser, error) {
+	var user structs.SysUser
+	err := db.Where("oidc_subject = ?", claims.Subject).First(&user).Error
+	if err == nil {
+		return &user, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	subject := claims.Subject
+	if claims.Email != "" && claims.EmailVerified {
+		err := db.Where("email = ? AND oidc_subject IS NULL", claims.Email).First(&user).Error
+		if err == nil {
+			if !linkableByEmail(&user) {
+				return nil, fmt.Errorf("An account with this email exists; ask an administrator to link it")
+			}
+			if err := db.Model(&user).Update("oidc_subject", subject).Error; err != nil {
+				return nil, err
+			}
+			user.OidcSubject = &subject
+			return &user, nil
+		}
+		if err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+	}
+
+	if !p.config.AutoProvision {
+		return nil, fmt.Errorf("No user is linked to this account")
+	}
+	username, err := availableUsername(db, claims.PreferredUsername, claims.Email, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	user = structs.SysUser{
+		Username:    username,
+		Email:       claims.Email,
+		DisplayName: claims.Name,
+		Role:        structs.RoleUser,
+		Active:      true,
+		OidcSubject: &subject,
+		AuthSource:  structs.AuthSourceOIDC,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		return nil, err
+	}
+	log.Printf("provisioned user %s for OIDC subject %s", user.Username, subject)
+	return &user, nil
+}
+
+func linkableByEmail(user *structs.SysUser) bool {
+	return user.Role != structs.RoleAdmin && user.Password == "" && user.AuthSource != structs.AuthSourceLDAP
+}
+
+// availableUsername returns the first candidate no user has taken yet.
+func availableUsername(db *gorm.DB, candidates ...string) (string, error) {
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		var count int64
+		if err := db.Model(&structs.SysUser{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("No free username for this account")
+}
+
+// randomToken returns n random bytes, base64url encoded.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,384 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "reports"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "https://reports.example.com/oidc/callback"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token
+// endpoint that enforces PKCE and client authentication.
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+	claims    oidcClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, grants: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "idp-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize plays the user signing in at the provider: it checks the
+// authorization request and returns a code that yields claims.
+func (idp *mockIdP) authorize(authURL string, claims oidcClaims) (code, state string) {
+	idp.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("client_id") != testClientID || q.Get("redirect_uri") != testRedirectURL || q.Get("response_type") != "code" {
+		idp.t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		idp.t.Fatalf("authorization request without PKCE: %s", authURL)
+	}
+
+	code = base64.RawURLEncoding.EncodeToString([]byte(q.Get("state")))
+	idp.mu.Lock()
+	idp.grants[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	idp.mu.Unlock()
+	return code, q.Get("state")
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if id, secret, ok := r.BasicAuth(); !ok || id != testClientID || secret != testClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.Form.Get("code")]
+	delete(idp.grants, r.Form.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge || r.Form.Get("redirect_uri") != testRedirectURL {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := grant.claims
+	if claims.Issuer == "" {
+		claims.Issuer = idp.server.URL
+	}
+	if claims.Audience == nil {
+		claims.Audience = jwt.ClaimStrings{testClientID}
+	}
+	if claims.Nonce == "" {
+		claims.Nonce = grant.nonce
+	}
+	claims.IssuedAt = jwt.NewNumericDate(time.Now())
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(5 * time.Minute))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp-1"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		idp.t.Error(err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": signed})
+}
+
+type oidcTest struct {
+	t        *testing.T
+	db       *gorm.DB
+	idp      *mockIdP
+	provider *OIDCProvider
+	// cookies are what the browser got from the last start.
+	cookies []*http.Cookie
+}
+
+func newOIDCTest(t *testing.T, autoProvision bool) *oidcTest {
+	db := newTestDB(t)
+	useTestKeyRing(t, db)
+	idp := newMockIdP(t)
+	provider := NewOIDCProvider(OIDCConfig{
+		Issuer:        idp.server.URL,
+		ClientID:      testClientID,
+		ClientSecret:  testClientSecret,
+		RedirectURL:   testRedirectURL,
+		AutoProvision: autoProvision,
+	})
+
+	oidcProviderOnce.Do(func() {})
+	previous := oidcProvider
+	oidcProvider = provider
+	t.Cleanup(func() { oidcProvider = previous })
+	return &oidcTest{t: t, db: db, idp: idp, provider: provider}
+}
+
+// start runs OIDCLogin and returns the provider URL it redirected to.
+func (o *oidcTest) start() string {
+	o.t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/oidc/login", nil)
+	OIDCLogin(c, o.db)
+	if w.Code != http.StatusFound {
+		o.t.Fatalf("login: got %d %s", w.Code, w.Body)
+	}
+	o.cookies = w.Result().Cookies()
+	return w.Header().Get("Location")
+}
+
+// callback runs OIDCCallback and returns the status and decoded body.
+func (o *oidcTest) callback(code, state string) (int, map[string]interface{}) {
+	o.t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	for _, cookie := range o.cookies {
+		c.Request.AddCookie(cookie)
+	}
+	OIDCCallback(c, o.db)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+// login runs the whole flow for an account with claims.
+func (o *oidcTest) login(claims oidcClaims) (int, map[string]interface{}) {
+	o.t.Helper()
+	code, state := o.idp.authorize(o.start(), claims)
+	return o.callback(code, state)
+}
+
+func subjectClaims(subject, email string, verified bool) oidcClaims {
+	return oidcClaims{
+		Email:             email,
+		EmailVerified:     verified,
+		PreferredUsername: subject,
+		RegisteredClaims:  jwt.RegisteredClaims{Subject: subject},
+	}
+}
+
+func TestOIDCProvisionsUserAndIssuesTokens(t *testing.T) {
+	o := newOIDCTest(t, true)
+
+	status, body := o.login(subjectClaims("alice", "alice@example.com", true))
+	if status != http.StatusOK || body["token"] == nil || body["refresh_token"] == nil {
+		t.Fatalf("got %d %v", status, body)
+	}
+	if _, err := parseClaims(body["token"].(string), TokenTypeAccess); err != nil {
+		t.Fatalf("issued token doesn't verify: %v", err)
+	}
+
+	var user structs.SysUser
+	if err := o.db.Where("oidc_subject = ?", "alice").First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.AuthSource != structs.AuthSourceOIDC || user.Role != structs.RoleUser || !user.Active {
+		t.Fatalf("unexpected provisioned user %+v", user)
+	}
+
+	// The second login finds the user by subject instead of creating one.
+	if status, body := o.login(subjectClaims("alice", "alice@example.com", true)); status != http.StatusOK {
+		t.Fatalf("second login: got %d %v", status, body)
+	}
+	var count int64
+	o.db.Model(&structs.SysUser{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("got %d users, want 1", count)
+	}
+}
+
+func TestOIDCWithoutAutoProvisionRejectsUnknownAccounts(t *testing.T) {
+	o := newOIDCTest(t, false)
+	if status, _ := o.login(subjectClaims("bob", "bob@example.com", true)); status != http.StatusForbidden {
+		t.Fatalf("got %d, want 403", status)
+	}
+}
+
+func TestOIDCRequiresPKCEVerifier(t *testing.T) {
+	o := newOIDCTest(t, true)
+	code, state := o.idp.authorize(o.start(), subjectClaims("alice", "", false))
+	// A stolen code is useless without the verifier kept server-side.
+	o.db.Model(&structs.SysOidcState{}).Where("state = ?", state).Update("code_verifier", "not-the-verifier-not-the-verifier-not-the-ver")
+	if status, _ := o.callback(code, state); status != http.StatusUnauthorized {
+		t.Fatalf("got %d, want 401", status)
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*oidcClaims)
+	}{
+		{"nonce mismatch", func(c *oidcClaims) { c.Nonce = "replayed-nonce" }},
+		{"wrong audience", func(c *oidcClaims) { c.Audience = jwt.ClaimStrings{"another-client"} }},
+		{"wrong issuer", func(c *oidcClaims) { c.Issuer = "https://evil.example.com" }},
+		{"extra audience without azp", func(c *oidcClaims) { c.Audience = jwt.ClaimStrings{testClientID, "another-client"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOIDCTest(t, true)
+			claims := subjectClaims("alice", "", false)
+			tt.modify(&claims)
+			if status, body := o.login(claims); status != http.StatusUnauthorized {
+				t.Fatalf("got %d %v, want 401", status, body)
+			}
+			var count int64
+			o.db.Model(&structs.SysUser{}).Count(&count)
+			if count != 0 {
+				t.Fatalf("a rejected login provisioned %d users", count)
+			}
+		})
+	}
+}
+
+func TestOIDCRejectsExpiredState(t *testing.T) {
+	o := newOIDCTest(t, true)
+	code, state := o.idp.authorize(o.start(), subjectClaims("alice", "", false))
+	o.db.Model(&structs.SysOidcState{}).Where("state = ?", state).Update("expires_at", time.Now().Add(-time.Minute))
+	if status, _ := o.callback(code, state); status != http.StatusUnauthorized {
+		t.Fatalf("got %d, want 401", status)
+	}
+}
+
+func TestOIDCRejectsReplayedState(t *testing.T) {
+	o := newOIDCTest(t, true)
+	code, state := o.idp.authorize(o.start(), subjectClaims("alice", "", false))
+	if status, body := o.callback(code, state); status != http.StatusOK {
+		t.Fatalf("first callback: got %d %v", status, body)
+	}
+	if status, _ := o.callback(code, state); status != http.StatusUnauthorized {
+		t.Fatalf("replayed callback: got %d, want 401", status)
+	}
+}
+
+func TestOIDCRequiresStateCookie(t *testing.T) {
+	o := newOIDCTest(t, true)
+	code, state := o.idp.authorize(o.start(), subjectClaims("alice", "", false))
+	if len(o.cookies) != 1 || !o.cookies[0].HttpOnly || o.cookies[0].SameSite != http.SameSiteLaxMode || o.cookies[0].Value == state {
+		t.Fatalf("state cookie: %+v", o.cookies)
+	}
+	ownCookies := o.cookies
+
+	// A victim's browser following the attacker's callback URL has no
+	// cookie, or one from a login of its own.
+	o.cookies = nil
+	if status, _ := o.callback(code, state); status != http.StatusUnauthorized {
+		t.Fatalf("no cookie: got %d, want 401", status)
+	}
+	o.start()
+	if status, _ := o.callback(code, state); status != http.StatusUnauthorized {
+		t.Fatalf("other login's cookie: got %d, want 401", status)
+	}
+
+	// The rejected callbacks didn't use up the state.
+	o.cookies = ownCookies
+	if status, body := o.callback(code, state); status != http.StatusOK {
+		t.Fatalf("own cookie: got %d %v", status, body)
+	}
+}
+
+func TestOIDCLinksByVerifiedEmail(t *testing.T) {
+	o := newOIDCTest(t, true)
+	existing := structs.SysUser{Username: "carol", Email: "carol@example.com", Role: structs.RoleUser, Active: true, AuthSource: structs.AuthSourceLocal}
+	o.db.Create(&existing)
+
+	if status, body := o.login(subjectClaims("idp-carol", "carol@example.com", true)); status != http.StatusOK {
+		t.Fatalf("got %d %v", status, body)
+	}
+	var user structs.SysUser
+	o.db.First(&user, existing.ID)
+	if user.OidcSubject == nil || *user.OidcSubject != "idp-carol" {
+		t.Fatalf("subject not linked: %+v", user)
+	}
+}
+
+func TestOIDCDoesNotLinkUnverifiedEmail(t *testing.T) {
+	o := newOIDCTest(t, true)
+	existing := structs.SysUser{Username: "carol", Email: "carol@example.com", Role: structs.RoleUser, Active: true, AuthSource: structs.AuthSourceLocal}
+	o.db.Create(&existing)
+
+	if status, body := o.login(subjectClaims("idp-carol", "carol@example.com", false)); status != http.StatusOK {
+		t.Fatalf("got %d %v", status, body)
+	}
+	var user structs.SysUser
+	o.db.First(&user, existing.ID)
+	if user.OidcSubject != nil {
+		t.Fatalf("unverified email linked %+v", user)
+	}
+}
+
+func TestOIDCDoesNotLinkPrivilegedAccountsByEmail(t *testing.T) {
+	accounts := map[string]structs.SysUser{
+		"admin":          {Username: "root", Email: "root@example.com", Role: structs.RoleAdmin, Active: true, AuthSource: structs.AuthSourceLocal},
+		"local password": {Username: "root", Email: "root@example.com", Role: structs.RoleUser, Active: true, AuthSource: structs.AuthSourceLocal, Password: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$aGFzaA"},
+		"directory":      {Username: "root", Email: "root@example.com", Role: structs.RoleUser, Active: true, AuthSource: structs.AuthSourceLDAP},
+	}
+	for name, account := range accounts {
+		t.Run(name, func(t *testing.T) {
+			o := newOIDCTest(t, true)
+			o.db.Create(&account)
+
+			if status, _ := o.login(subjectClaims("attacker", "root@example.com", true)); status != http.StatusForbidden {
+				t.Fatalf("got %d, want 403", status)
+			}
+			var user structs.SysUser
+			o.db.First(&user, account.ID)
+			if user.OidcSubject != nil {
+				t.Fatalf("account was linked: %+v", user)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PasswordPolicy holds the argon2id cost parameters. The defaults follow
+// the OWASP recommendation and can be raised through PASSWORD_ARGON2_TIME,
+// PASSWORD_ARGON2_MEMORY_KIB and PASSWORD_ARGON2_THREADS.
+type PasswordPolicy struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+var (
+	passwordPolicy     PasswordPolicy
+	passwordPolicyOnce sync.Once
+)
+
+func currentPasswordPolicy() PasswordPolicy {
+	passwordPolicyOnce.Do(func() {
+		loadEnv()
+		passwordPolicy = PasswordPolicy{Time: 3, Memory: 64 * 1024, Threads: 2, SaltLen: 16, KeyLen: 32}
+		if n, err := strconv.ParseUint(os.Getenv("PASSWORD_ARGON2_TIME"), 10, 32); err == nil && n > 0 {
+			passwordPolicy.Time = uint32(n)
+		}
+		if n, err := strconv.ParseUint(os.Getenv("PASSWORD_ARGON2_MEMORY_KIB"), 10, 32); err == nil && n > 0 {
+			passwordPolicy.Memory = uint32(n)
+		}
+		if n, err := strconv.ParseUint(os.Getenv("PASSWORD_ARGON2_THREADS"), 10, 8); err == nil && n > 0 {
+			passwordPolicy.Threads = uint8(n)
+		}
+	})
+	return passwordPolicy
+}
+
+// HashPassword returns password as an argon2id PHC string:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	policy := currentPasswordPolicy()
+	salt := make([]byte, policy.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, policy.Time, policy.Memory, policy.Threads, policy.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, policy.Memory, policy.Time, policy.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks password against encoded, which is either an
+// argon2id PHC string or a legacy unsalted SHA-1 hex digest. needsRehash
+// reports that a match should be stored again with HashPassword.
+func VerifyPassword(password, encoded string) (ok bool, needsRehash bool) {
+	if !strings.HasPrefix(encoded, "$argon2id$") {
+		return verifyLegacySHA1(password, encoded), true
+	}
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false
+	}
+
+	policy := currentPasswordPolicy()
+	needsRehash = memory != policy.Memory || time != policy.Time || threads != policy.Threads ||
+		uint32(len(salt)) != policy.SaltLen || uint32(len(want)) != policy.KeyLen
+	return true, needsRehash
+}
+
+func verifyLegacySHA1(password, hash string) bool {
+	sum := sha1.Sum([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(hash))) == 1
+}
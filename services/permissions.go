@@ -0,0 +1,298 @@
+package services
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUserNotFound = fmt.Errorf("user not found")
+	ErrUserDisabled = fmt.Errorf("user is disabled")
+)
+
+// impliedPermissions lists what each permission grants besides itself:
+// exporting means running, running and editing mean viewing, and
+// report:admin means everything.
+var impliedPermissions = map[string][]string{
+	structs.PermReportAdmin:  {structs.PermReportEdit, structs.PermReportExport, structs.PermReportRun, structs.PermReportView},
+	structs.PermReportEdit:   {structs.PermReportView},
+	structs.PermReportExport: {structs.PermReportRun, structs.PermReportView},
+	structs.PermReportRun:    {structs.PermReportView},
+}
+
+// Permissions is what a principal may do with reports, split by the scope
+// each permission was granted at. An API key narrows its owner's
+// permissions further through limit.
+type Permissions struct {
+	global  map[string]bool
+	modules map[string]map[string]bool
+	reports map[uint]map[string]bool
+	limit   *permissionLimit
+}
+
+// permissionLimit keeps only the listed permissions and, when reports
+// isn't empty, only the listed reports.
+type permissionLimit struct {
+	permissions map[string]bool
+	reports     map[uint]bool
+}
+
+// Restrict returns p limited to permissions and, if reportIDs isn't empty,
+// to those reports. Implied permissions are not added: a key scoped to
+// report:export can't view report definitions unless report:view is listed.
+func (p *Permissions) Restrict(permissions []string, reportIDs []uint) *Permissions {
+	limit := &permissionLimit{permissions: make(map[string]bool), reports: make(map[uint]bool)}
+	for _, permission := range permissions {
+		limit.permissions[permission] = true
+	}
+	for _, id := range reportIDs {
+		limit.reports[id] = true
+	}
+	restricted := *p
+	restricted.limit = limit
+	return &restricted
+}
+
+func (p *Permissions) limited(permission string) bool {
+	return p.limit != nil && !p.limit.permissions[permission]
+}
+
+func newPermissions() *Permissions {
+	return &Permissions{
+		global:  make(map[string]bool),
+		modules: make(map[string]map[string]bool),
+		reports: make(map[uint]map[string]bool),
+	}
+}
+
+func grantTo(set map[string]bool, permission string) {
+	set[permission] = true
+	for _, implied := range impliedPermissions[permission] {
+		set[implied] = true
+	}
+}
+
+func (p *Permissions) grant(permission, module string, reportID *uint) {
+	switch {
+	case reportID != nil:
+		if p.reports[*reportID] == nil {
+			p.reports[*reportID] = make(map[string]bool)
+		}
+		grantTo(p.reports[*reportID], permission)
+	case module != "":
+		if p.modules[module] == nil {
+			p.modules[module] = make(map[string]bool)
+		}
+		grantTo(p.modules[module], permission)
+	default:
+		grantTo(p.global, permission)
+	}
+}
+
+// Has reports whether permission was granted globally.
+func (p *Permissions) Has(permission string) bool {
+	if p.limited(permission) || (p.limit != nil && len(p.limit.reports) > 0) {
+		return false
+	}
+	return p.global[permission]
+}
+
+// CanInModule reports whether permission applies to every report in module.
+func (p *Permissions) CanInModule(permission, module string) bool {
+	if p.limited(permission) || (p.limit != nil && len(p.limit.reports) > 0) {
+		return false
+	}
+	return p.global[permission] || p.modules[module][permission]
+}
+
+// Can reports whether permission applies to report.
+func (p *Permissions) Can(permission string, report structs.SysMetaRpt) bool {
+	if p.limited(permission) || (p.limit != nil && len(p.limit.reports) > 0 && !p.limit.reports[report.ID]) {
+		return false
+	}
+	return p.global[permission] || p.modules[report.Module][permission] || p.reports[report.ID][permission]
+}
+
+// FilterReports narrows a sys_meta_rpt query to the reports permission
+// applies to.
+func (p *Permissions) FilterReports(db *gorm.DB, permission string) *gorm.DB {
+	if p.limited(permission) {
+		return db.Where("1 = 0")
+	}
+	if p.limit != nil && len(p.limit.reports) > 0 {
+		var ids []uint
+		for id := range p.limit.reports {
+			ids = append(ids, id)
+		}
+		db = db.Where("id IN ?", ids)
+	}
+	if p.global[permission] {
+		return db
+	}
+
+	var modules []string
+	for module, set := range p.modules {
+		if set[permission] {
+			modules = append(modules, module)
+		}
+	}
+	var reportIDs []uint
+	for id, set := range p.reports {
+		if set[permission] {
+			reportIDs = append(reportIDs, id)
+		}
+	}
+	if len(modules) == 0 && len(reportIDs) == 0 {
+		return db.Where("1 = 0")
+	}
+	return db.Where("module IN ? OR id IN ?", modules, reportIDs)
+}
+
+// LoadPermissions collects the permissions of username from the roles
+// granted to the user and to their groups. Admin users hold report:admin
+// globally, and DEFAULT_REPORT_PERMISSIONS is granted globally to every
+// active user.
+func LoadPermissions(db *gorm.DB, username string) (*structs.SysUser, *Permissions, error) {
+	var user structs.SysUser
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, nil, ErrUserNotFound
+	}
+	if !user.Active {
+		return &user, nil, ErrUserDisabled
+	}
+
+	perms := newPermissions()
+	if user.Role == structs.RoleAdmin {
+		perms.grant(structs.PermReportAdmin, "", nil)
+	}
+	for _, permission := range defaultPermissions() {
+		perms.grant(permission, "", nil)
+	}
+
+	var groupIDs []uint
+	if err := db.Model(&structs.SysGroupMember{}).Where("user_id = ?", user.ID).Pluck("group_id", &groupIDs).Error; err != nil {
+		return &user, nil, err
+	}
+
+	var grants []struct {
+		Module      string
+		ReportID    *uint
+		Permissions string
+	}
+	query := db.Table("sys_role_grant").
+		Select("sys_role_grant.module, sys_role_grant.report_id, sys_role.permissions").
+		Joins("JOIN sys_role ON sys_role.id = sys_role_grant.role_id")
+	if len(groupIDs) > 0 {
+		query = query.Where("sys_role_grant.user_id = ? OR sys_role_grant.group_id IN ?", user.ID, groupIDs)
+	} else {
+		query = query.Where("sys_role_grant.user_id = ?", user.ID)
+	}
+	if err := query.Scan(&grants).Error; err != nil {
+		return &user, nil, err
+	}
+
+	for _, g := range grants {
+		for _, permission := range splitPermissions(g.Permissions) {
+			perms.grant(permission, g.Module, g.ReportID)
+		}
+	}
+	return &user, perms, nil
+}
+
+func defaultPermissions() []string {
+	return splitPermissions(os.Getenv("DEFAULT_REPORT_PERMISSIONS"))
+}
+
+func splitPermissions(list string) []string {
+	var permissions []string
+	for _, permission := range strings.Split(list, ",") {
+		if permission = strings.TrimSpace(permission); permission != "" {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions
+}
+
+// ValidPermission reports whether permission is one of the report
+// permissions.
+func ValidPermission(permission string) bool {
+	switch permission {
+	case structs.PermReportView, structs.PermReportRun, structs.PermReportExport, structs.PermReportEdit, structs.PermReportAdmin:
+		return true
+	}
+	return false
+}
+
+// PermissionsFrom returns the permissions AuthenticateJWT loaded for the
+// request. A request that skipped it gets none.
+func PermissionsFrom(c *gin.Context) *Permissions {
+	if perms, ok := c.Get("permissions"); ok {
+		return perms.(*Permissions)
+	}
+	return newPermissions()
+}
+
+// RequirePermission lets the request through only if permission was
+// granted globally.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !PermissionsFrom(c).Has(permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireReportPermission checks permission against the report named by
+// the :id route parameter, at global, module or report scope. Reports of
+// other sites answer 404 as if they didn't exist.
+func RequireReportPermission(db *gorm.DB, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid ID format"})
+			return
+		}
+		var report structs.SysMetaRpt
+		if err := db.Select("id", "module", "site_id").First(&report, "id = ?", id).Error; err != nil || !ReportInSite(report, c.GetUint("site_id")) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+			return
+		}
+		if !PermissionsFrom(c).Can(permission, report) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CheckReportPermission is RequireReportPermission for WebSocket commands,
+// which have no gin request. HTTP handlers use PermissionsFrom instead: an
+// API key's permissions exist only on the request. issuedAt is when the
+// connection's token was issued, so a revoked session loses its open
+// connections too.
+func CheckReportPermission(db *gorm.DB, scope QueryScope, issuedAt time.Time, reportID int, permission string) error {
+	claims := &Claims{Username: scope.Username, SiteID: scope.SiteID}
+	claims.IssuedAt = jwt.NewNumericDate(issuedAt)
+	_, perms, err := checkPrincipal(db, claims)
+	if err != nil {
+		return err
+	}
+	var report structs.SysMetaRpt
+	if err := db.Select("id", "module", "site_id").First(&report, "id = ?", reportID).Error; err != nil || !ReportInSite(report, scope.SiteID) {
+		return ErrReportNotFound
+	}
+	if !perms.Can(permission, report) {
+		return fmt.Errorf("missing permission %s", permission)
+	}
+	return nil
+}
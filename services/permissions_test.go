@@ -0,0 +1,123 @@
+package services
+
+import (
+	"go-report-management/structs"
+	"testing"
+)
+
+func TestLoadPermissionsScopes(t *testing.T) {
+	t.Setenv("DEFAULT_REPORT_PERMISSIONS", "")
+	db := newTestDB(t)
+	viewer := structs.SysRole{Name: "viewer", Permissions: structs.PermReportView}
+	runner := structs.SysRole{Name: "runner", Permissions: structs.PermReportRun}
+	editor := structs.SysRole{Name: "editor", Permissions: structs.PermReportEdit}
+	db.Create(&viewer)
+	db.Create(&runner)
+	db.Create(&editor)
+
+	user := structs.SysUser{Username: "alice", Role: structs.RoleUser, Active: true}
+	db.Create(&user)
+	group := structs.SysGroup{Name: "analysts"}
+	db.Create(&group)
+	db.Create(&structs.SysGroupMember{GroupID: group.ID, UserID: user.ID})
+
+	reportID := uint(7)
+	db.Create(&structs.SysRoleGrant{RoleID: viewer.ID, GroupID: &group.ID})
+	db.Create(&structs.SysRoleGrant{RoleID: runner.ID, UserID: &user.ID, Module: "finance"})
+	db.Create(&structs.SysRoleGrant{RoleID: editor.ID, UserID: &user.ID, ReportID: &reportID})
+
+	_, perms, err := LoadPermissions(db, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finance := structs.SysMetaRpt{ID: 1, Module: "finance"}
+	sales := structs.SysMetaRpt{ID: 2, Module: "sales"}
+	granted := structs.SysMetaRpt{ID: reportID, Module: "sales"}
+
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"global view through group", perms.Has(structs.PermReportView), true},
+		{"no global run", perms.Has(structs.PermReportRun), false},
+		{"run in module", perms.CanInModule(structs.PermReportRun, "finance"), true},
+		{"no run in other module", perms.CanInModule(structs.PermReportRun, "sales"), false},
+		{"run report of module", perms.Can(structs.PermReportRun, finance), true},
+		{"no run report of other module", perms.Can(structs.PermReportRun, sales), false},
+		{"view any report", perms.Can(structs.PermReportView, sales), true},
+		{"edit granted report", perms.Can(structs.PermReportEdit, granted), true},
+		{"no edit other report", perms.Can(structs.PermReportEdit, sales), false},
+		{"no export", perms.Can(structs.PermReportExport, finance), false},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadPermissionsAdminAndDefaults(t *testing.T) {
+	t.Setenv("DEFAULT_REPORT_PERMISSIONS", "report:view, report:run")
+	db := newTestDB(t)
+	admin := structs.SysUser{Username: "root", Role: structs.RoleAdmin, Active: true}
+	user := structs.SysUser{Username: "bob", Role: structs.RoleUser, Active: true}
+	db.Create(&admin)
+	db.Create(&user)
+
+	_, perms, err := LoadPermissions(db, admin.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, permission := range []string{structs.PermReportAdmin, structs.PermReportEdit, structs.PermReportExport} {
+		if !perms.Has(permission) {
+			t.Errorf("admin lacks %s", permission)
+		}
+	}
+
+	_, perms, err = LoadPermissions(db, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !perms.Has(structs.PermReportRun) || perms.Has(structs.PermReportExport) {
+		t.Errorf("defaults: run %v, export %v", perms.Has(structs.PermReportRun), perms.Has(structs.PermReportExport))
+	}
+
+	db.Model(&user).Update("active", false)
+	if _, _, err := LoadPermissions(db, user.Username); err != ErrUserDisabled {
+		t.Fatalf("disabled user: got %v, want ErrUserDisabled", err)
+	}
+	if _, _, err := LoadPermissions(db, "nobody"); err != ErrUserNotFound {
+		t.Fatalf("unknown user: got %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	perms := newPermissions()
+	perms.grant(structs.PermReportAdmin, "", nil)
+	first := structs.SysMetaRpt{ID: 1, Module: "finance"}
+	second := structs.SysMetaRpt{ID: 2, Module: "finance"}
+
+	byScope := perms.Restrict([]string{structs.PermReportRun}, nil)
+	if !byScope.Has(structs.PermReportRun) || !byScope.Can(structs.PermReportRun, second) {
+		t.Error("scope limit dropped a listed permission")
+	}
+	// Implied permissions aren't added back.
+	if byScope.Can(structs.PermReportView, first) || byScope.Can(structs.PermReportExport, first) {
+		t.Error("scope limit kept an unlisted permission")
+	}
+
+	byReport := perms.Restrict([]string{structs.PermReportRun}, []uint{first.ID})
+	if !byReport.Can(structs.PermReportRun, first) || byReport.Can(structs.PermReportRun, second) {
+		t.Error("report limit not applied")
+	}
+	// A report limit rules out anything granted more widely than a report.
+	if byReport.Has(structs.PermReportRun) || byReport.CanInModule(structs.PermReportRun, "finance") {
+		t.Error("report limit allowed a global or module check")
+	}
+
+	// Restricting a copy leaves the original alone.
+	if !perms.Can(structs.PermReportExport, second) {
+		t.Error("Restrict changed the receiver")
+	}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"go-report-management/structs"
+	"strings"
+)
+
+const (
+	MaxPivotColumns = 200
+	MaxPivotCells   = 100000
+)
+
+type PivotRow struct {
+	Keys   []interface{} `json:"keys"`
+	Values []interface{} `json:"values"`
+}
+
+type PivotData struct {
+	RowHeaders []string      `json:"row_headers"`
+	Columns    []interface{} `json:"columns"`
+	Rows       []PivotRow    `json:"rows"`
+}
+
+func GetPivotData(db *sql.DB, scope QueryScope, reportID int, filters map[string]string, pivot *structs.PivotSpec) (*PivotData, error) {
+	spec := &AggregateSpec{
+		GroupBy: append(append([]string{}, pivot.Rows...), pivot.Column),
+		Metrics: []Metric{{Function: pivot.Aggregate, Column: pivot.Value, Alias: "pivot_value"}},
+	}
+	aggregateSQL, err := BuildAggregateSQL(db, scope, reportID, filters, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	results, _, err := querySQL(db, aggregateSQL, 0, MaxPivotCells+1)
+	if err != nil {
+		return nil, fmt.Errorf("error executing pivot query: %v", err)
+	}
+	if len(results) > MaxPivotCells {
+		return nil, invalidf("pivot has more than %d cells, add filters to narrow it", MaxPivotCells)
+	}
+
+	data := &PivotData{RowHeaders: pivot.Rows, Columns: []interface{}{}, Rows: []PivotRow{}}
+	columnIndex := make(map[string]int)
+	rowIndex := make(map[string]int)
+
+	for _, result := range results {
+		columnKey := fmt.Sprint(result[pivot.Column])
+		if _, ok := columnIndex[columnKey]; !ok {
+			if len(data.Columns) == MaxPivotColumns {
+				return nil, invalidf("pivot column %s has more than %d distinct values", pivot.Column, MaxPivotColumns)
+			}
+			columnIndex[columnKey] = len(data.Columns)
+			data.Columns = append(data.Columns, result[pivot.Column])
+		}
+	}
+
+	for _, result := range results {
+		keys := make([]interface{}, len(pivot.Rows))
+		keyParts := make([]string, len(pivot.Rows))
+		for i, row := range pivot.Rows {
+			keys[i] = result[row]
+			keyParts[i] = fmt.Sprint(result[row])
+		}
+		rowKey := strings.Join(keyParts, "\x00")
+
+		idx, ok := rowIndex[rowKey]
+		if !ok {
+			idx = len(data.Rows)
+			rowIndex[rowKey] = idx
+			data.Rows = append(data.Rows, PivotRow{Keys: keys, Values: make([]interface{}, len(data.Columns))})
+		}
+		data.Rows[idx].Values[columnIndex[fmt.Sprint(result[pivot.Column])]] = result["pivot_value"]
+	}
+
+	return data, nil
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"go-report-management/events"
+	"sync"
+	"time"
+)
+
+const (
+	PhaseQuery = "query"
+	PhaseWrite = "write"
+
+	progressInterval = time.Second
+)
+
+// progressTracker turns row counts from the query and write phases into
+// throttled progress events. Each phase counts for half of the percentage,
+// and the ETA comes from the throughput observed since the export started.
+type progressTracker struct {
+	job   *Job
+	total int
+
+	mu       sync.Mutex
+	queried  int
+	written  int
+	started  time.Time
+	lastSent time.Time
+}
+
+func newProgressTracker(job *Job, total int) *progressTracker {
+	return &progressTracker{job: job, total: total, started: time.Now()}
+}
+
+func (p *progressTracker) addQueried(rows int) {
+	p.mu.Lock()
+	p.queried += rows
+	p.mu.Unlock()
+	p.report()
+}
+
+func (p *progressTracker) addWritten(rows int) {
+	p.mu.Lock()
+	p.written += rows
+	p.mu.Unlock()
+	p.report()
+}
+
+func (p *progressTracker) report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.total == 0 || now.Sub(p.lastSent) < progressInterval {
+		return
+	}
+	p.lastSent = now
+
+	msg := events.Message{Type: events.MessageProgress, RowsTotal: p.total}
+	if p.queried < p.total {
+		msg.Phase = PhaseQuery
+		msg.RowsDone = p.queried
+	} else {
+		msg.Phase = PhaseWrite
+		msg.RowsDone = p.written
+	}
+
+	done := p.queried + p.written
+	msg.Percent = float64(done) / float64(2*p.total) * 100
+	if elapsed := now.Sub(p.started).Seconds(); done > 0 && elapsed > 0 {
+		rate := float64(done) / elapsed
+		msg.ETASeconds = int(float64(2*p.total-done)/rate + 0.5)
+	}
+
+	// Notifying under mu keeps events in the order their counts were taken.
+	p.job.notify(msg)
+}
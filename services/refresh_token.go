@@ -0,0 +1,214 @@
+package services
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrSessionRevoked      = fmt.Errorf("Session has been revoked")
+	errInvalidRefreshToken = fmt.Errorf("Invalid refresh token")
+	errRefreshTokenReused  = fmt.Errorf("Refresh token reuse detected, all sessions of this login were revoked")
+)
+
+// GenerateRefreshJWT issues a one-time refresh token for user and stores it
+// under its jti. An empty familyID starts a new family, i.e. a new login.
+func GenerateRefreshJWT(db *gorm.DB, user *structs.SysUser, siteID uint, familyID string) (string, error) {
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+
+	now := time.Now()
+	stored := structs.SysRefreshToken{
+		ID:        uuid.New().String(),
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		SiteID:    siteID,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}
+	if err := db.Create(&stored).Error; err != nil {
+		return "", err
+	}
+	// Expired tokens can't be replayed anyway, so there is nothing to keep.
+	if err := db.Where("user_id = ? AND expires_at < ?", user.ID, now).Delete(&structs.SysRefreshToken{}).Error; err != nil {
+		log.Printf("error pruning refresh tokens for user %s: %v", user.Username, err)
+	}
+
+	claims := &Claims{
+		Username:  user.Username,
+		SiteID:    siteID,
+		TokenType: TokenTypeRefresh,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        stored.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(stored.ExpiresAt),
+			Issuer:    "your_app_name",
+		},
+	}
+
+	return keyRing.sign(claims)
+}
+
+func parseRefreshToken(tokenString string) (*Claims, error) {
+	return parseClaims(tokenString, TokenTypeRefresh)
+}
+
+// RefreshToken trades a refresh token for a new token pair. Each refresh
+// token works once: presenting a spent one means it was stolen or replayed,
+// so the whole family is revoked and its holder has to log in again.
+func RefreshToken(c *gin.Context, db *gorm.DB) {
+	var requestBody struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	claims, err := parseRefreshToken(requestBody.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	var user structs.SysUser
+	var stored structs.SysRefreshToken
+	var reused bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&stored, "id = ?", claims.ID).Error; err != nil {
+			return errInvalidRefreshToken
+		}
+		if stored.RevokedAt != nil {
+			return errInvalidRefreshToken
+		}
+		if stored.UsedAt != nil {
+			// Commit the revocation rather than rolling it back with the error.
+			reused = true
+			return revokeFamily(tx, stored.FamilyID)
+		}
+
+		now := time.Now()
+		if err := tx.Model(&stored).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&user, stored.UserID).Error; err != nil || !user.Active || sessionRevoked(&user, claims) {
+			return errInvalidRefreshToken
+		}
+		if member, err := isSiteMember(tx, user.ID, stored.SiteID); err != nil || !member {
+			return errInvalidRefreshToken
+		}
+		return nil
+	})
+	if reused {
+		log.Printf("refresh token reuse for user %s, revoked family %s", claims.Username, stored.FamilyID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errRefreshTokenReused.Error()})
+		return
+	}
+	if err == errInvalidRefreshToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not refresh token"})
+		return
+	}
+
+	tokenString, err := GenerateJWT(user.Username, stored.SiteID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create token"})
+		return
+	}
+	refreshToken, err := GenerateRefreshJWT(db, &user, stored.SiteID, stored.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": tokenString, "refresh_token": refreshToken})
+}
+
+// Logout revokes the family of the given refresh token, ending that login
+// on every device it was refreshed from. Its access token lapses on its
+// own within accessTokenTTL.
+func Logout(c *gin.Context, db *gorm.DB) {
+	var requestBody struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	claims, err := parseRefreshToken(requestBody.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	var stored structs.SysRefreshToken
+	if err := db.First(&stored, "id = ?", claims.ID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err := revokeFamily(db, stored.FamilyID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log out"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// LogoutAll ends every session of the authenticated user, access tokens
+// included.
+func LogoutAll(c *gin.Context, db *gorm.DB) {
+	var user structs.SysUser
+	if err := db.Where("username = ?", c.GetString("username")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := RevokeAllSessions(db, &user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log out"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+}
+
+// RevokeAllSessions revokes every refresh token of user and makes
+// AuthenticateJWT reject the access tokens issued so far.
+func RevokeAllSessions(db *gorm.DB, user *structs.SysUser) error {
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&structs.SysRefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", user.ID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(user).Update("sessions_revoked_at", now).Error
+	})
+}
+
+func revokeFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&structs.SysRefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// sessionRevoked reports whether claims were issued before the user's last
+// "log out all sessions". JWT times have whole seconds, so a token from the
+// same second as the revocation can't be told apart from an earlier one and
+// is revoked too; at worst a login in that second has to be repeated.
+func sessionRevoked(user *structs.SysUser, claims *Claims) bool {
+	if user.SessionsRevokedAt == nil {
+		return false
+	}
+	return claims.IssuedAt == nil || !claims.IssuedAt.Time.After(user.SessionsRevokedAt.Truncate(time.Second))
+}
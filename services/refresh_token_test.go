@@ -0,0 +1,36 @@
+package services
+
+import (
+	"github.com/golang-jwt/jwt/v4"
+	"go-report-management/structs"
+	"testing"
+	"time"
+)
+
+func TestSessionRevoked(t *testing.T) {
+	revokedAt := time.Date(2024, 5, 1, 12, 0, 0, 700_000_000, time.UTC)
+	user := &structs.SysUser{SessionsRevokedAt: &revokedAt}
+	tests := []struct {
+		name     string
+		issuedAt *jwt.NumericDate
+		revoked  bool
+	}{
+		{"no iat", nil, true},
+		{"earlier second", jwt.NewNumericDate(revokedAt.Add(-time.Second)), true},
+		// Issued in the same second, possibly just before the revocation.
+		{"same second", jwt.NewNumericDate(revokedAt), true},
+		{"next second", jwt.NewNumericDate(revokedAt.Add(time.Second)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{IssuedAt: tt.issuedAt}}
+			if got := sessionRevoked(user, claims); got != tt.revoked {
+				t.Fatalf("got %v, want %v", got, tt.revoked)
+			}
+		})
+	}
+
+	if sessionRevoked(&structs.SysUser{}, &Claims{}) {
+		t.Fatal("revoked without a revocation")
+	}
+}
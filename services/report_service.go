@@ -1,28 +1,65 @@
 package services
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"github.com/xuri/excelize/v2"
+	"go-report-management/structs"
 	"go-report-management/utils"
-	"go-report-management/websockets"
 	"log"
 	"strings"
 	"sync"
 )
 
-func GenerateReport(db *sql.DB, reportID int, blockSize int, filters map[string]string, clientID string) {
-	query, whereClause, err := GetQueryByID(db, reportID)
+// ReportQuery is a stored report as a principal may run it. Policies are
+// its row-level security rules, already bound to that principal;
+// reportSubquery applies them to every statement built from it.
+type ReportQuery struct {
+	Query    string
+	Where    string
+	Policies []string
+}
+
+type queryChunk struct {
+	columns []utils.Column
+	results []map[string]interface{}
+}
+
+func GenerateReport(db *sql.DB, job *Job, blockSize int, filters map[string]string, pivot *structs.PivotSpec) {
+	rq, err := GetQueryByID(db, job.ReportID, job.scope)
 	if err != nil {
 		log.Printf("error getting query by ID: %v", err)
+		job.failed(fmt.Errorf("report not found"))
 		return
 	}
-	fmt.Println("entro")
-	havingClause := buildHavingClause(filters)
+	havingClause, err := buildHavingClause(filters)
+	if err != nil {
+		job.failed(err)
+		return
+	}
+
+	specs, err := GetColumnSpecsByID(db, job.ReportID)
+	if err != nil {
+		log.Printf("error getting column specs: %v", err)
+	}
+
+	writer := utils.NewExcelWriter(specs)
+	writer.Chart, err = GetChartSpecByID(db, job.ReportID)
+	if err != nil {
+		log.Printf("error getting chart definition: %v", err)
+	}
+	writer.Pivot = pivot
+
+	exportSQL(db, job, reportSubquery(rq, havingClause), blockSize, writer)
+}
 
-	totalRows, err := GetTotalRows(db, query, whereClause, havingClause)
+// exportSQL runs sourceSQL in blocks of blockSize rows, writes them through
+// writer and uploads the finished workbook.
+func exportSQL(db *sql.DB, job *Job, sourceSQL string, blockSize int, writer *utils.ExcelWriter) {
+	totalRows, err := countSQL(db, sourceSQL)
 	if err != nil {
 		log.Printf("error getting total rows: %v", err)
+		job.failed(fmt.Errorf("error counting report rows"))
 		return
 	}
 
@@ -31,73 +68,76 @@ func GenerateReport(db *sql.DB, reportID int, blockSize int, filters map[string]
 		chunks++
 	}
 
-	resultsChan := make(chan []map[string]interface{}, chunks)
+	resultsChan := make(chan queryChunk, chunks)
 	var wgChunks sync.WaitGroup
-
-	f := excelize.NewFile()
-	headersWritten := false
-	var headers []string
-	sheetIndex := 1
-	rowIndex := 1
-	sheetName := fmt.Sprintf("Sheet%d", sheetIndex)
-	f.NewSheet(sheetName)
+	var chunkErr error
+	var chunkErrOnce sync.Once
+	progress := newProgressTracker(job, totalRows)
 
 	go func() {
-		for results := range resultsChan {
-			if !headersWritten {
-				headers = make([]string, 0, len(results[0]))
-				for header := range results[0] {
-					headers = append(headers, header)
-				}
-				utils.WriteHeaders(f, headers, sheetName)
-				headersWritten = true
+		for chunk := range resultsChan {
+			if job.ctx.Err() != nil {
+				continue
 			}
-
-			utils.WriteResults(f, headers, results, &rowIndex, &sheetIndex, &sheetName)
+			if err := writer.WriteRows(chunk.columns, chunk.results); err != nil {
+				log.Printf("error writing Excel rows: %v", err)
+			}
+			progress.addWritten(len(chunk.results))
+		}
+		if job.ctx.Err() != nil {
+			job.cancelled()
+			return
 		}
-		filename, err := utils.SaveExcelFile(f, reportID)
+		if chunkErr != nil {
+			job.failed(chunkErr)
+			return
+		}
+		if err := writer.Finish(); err != nil {
+			log.Printf("error formatting Excel report: %v", err)
+		}
+		filename, err := utils.SaveExcelFile(writer.File, job.ReportID)
 		if err != nil {
 			log.Printf("error saving Excel report: %v", err)
+			job.failed(fmt.Errorf("error saving Excel report"))
 		} else {
 			log.Printf("Excel file created successfully: %s", filename)
 			fileURL := fmt.Sprintf("https://reportstesting.sfo3.digitaloceanspaces.com/reports/reports/%s", filename)
-			websockets.NotifyClient(clientID, fileURL)
+			job.completed(fileURL, totalRows)
 		}
 	}()
 
 	for i := 0; i < chunks; i++ {
 		offset := i * blockSize
 		wgChunks.Add(1)
-		go func(offset, chunkNumber int) {
+		go func(offset int) {
 			defer wgChunks.Done()
-			results, err := ExecuteQuery(db, query, whereClause, havingClause, offset, blockSize)
+			results, columns, err := querySQLContext(job.ctx, db, sourceSQL, offset, blockSize)
 			if err != nil {
 				log.Printf("error executing query block: %v", err)
+				chunkErrOnce.Do(func() { chunkErr = fmt.Errorf("error executing report query") })
 				return
 			}
-			resultsChan <- results
-
-			progress := float64(chunkNumber+1) / float64(chunks) * 100
-
-			progressString := fmt.Sprintf("%.2f%%", progress)
-
-			websockets.NotifyClient(clientID, progressString)
-		}(offset, i)
+			progress.addQueried(len(results))
+			resultsChan <- queryChunk{columns: columns, results: results}
+		}(offset)
 	}
 
 	wgChunks.Wait()
 	close(resultsChan)
 }
 
-func GetReportDataPaginated(db *sql.DB, reportID, limit, offset int, filters map[string]string) ([]map[string]interface{}, error) {
-	query, whereClause, err := GetQueryByID(db, reportID)
+func GetReportDataPaginated(db *sql.DB, scope QueryScope, reportID, limit, offset int, filters map[string]string) ([]map[string]interface{}, error) {
+	rq, err := GetQueryByID(db, reportID, scope)
 	if err != nil {
 		return nil, fmt.Errorf("error getting query by ID: %v", err)
 	}
 
-	havingClause := buildHavingClause(filters)
+	havingClause, err := buildHavingClause(filters)
+	if err != nil {
+		return nil, err
+	}
 
-	results, err := ExecuteQuery(db, query, whereClause, havingClause, offset, limit)
+	results, err := ExecuteQuery(db, rq, havingClause, offset, limit)
 	if err != nil {
 		return nil, fmt.Errorf("error executing query: %v", err)
 	}
@@ -105,35 +145,79 @@ func GetReportDataPaginated(db *sql.DB, reportID, limit, offset int, filters map
 	return results, nil
 }
 
-func GetQueryByID(db *sql.DB, id int) (string, string, error) {
+// GetQueryByID returns the report as scope may run it: reports of another
+// site are not found, :site_id is bound to the scope's site and the
+// report's row-level security rules are bound to the scope's user.
+func GetQueryByID(db *sql.DB, id int, scope QueryScope) (ReportQuery, error) {
 	var query, whereClause string
-	err := db.QueryRow("SELECT query, _where FROM sys_meta_rpt WHERE id = ?", id).Scan(&query, &whereClause)
+	var siteID sql.NullInt64
+	err := db.QueryRow("SELECT query, _where, site_id FROM sys_meta_rpt WHERE id = ?", id).Scan(&query, &whereClause, &siteID)
 	if err != nil {
 		log.Printf("Error fetching query by ID: %v\n", err)
-		return "", "", err
+		return ReportQuery{}, err
+	}
+	if siteID.Valid && uint(siteID.Int64) != scope.SiteID {
+		return ReportQuery{}, ErrReportNotFound
+	}
+
+	policies, err := loadRowPolicies(db, id, scope)
+	if err != nil {
+		log.Printf("Error loading row policies: %v\n", err)
+		return ReportQuery{}, err
 	}
-	return query, whereClause, nil
+	return ReportQuery{Query: bindSiteParam(query, scope), Where: bindSiteParam(whereClause, scope), Policies: policies}, nil
 }
 
-func ExecuteQuery(db *sql.DB, query, whereClause, havingClause string, offset, limit int) ([]map[string]interface{}, error) {
-	var paginatedQuery string
-	if havingClause == "" {
-		paginatedQuery = fmt.Sprintf("%s WHERE %s LIMIT %d OFFSET %d", query, whereClause, limit, offset)
-	} else {
-		paginatedQuery = fmt.Sprintf("%s WHERE %s HAVING %s LIMIT %d OFFSET %d", query, whereClause, havingClause, limit, offset)
+func GetColumnSpecsByID(db *sql.DB, id int) (map[string]structs.ColumnSpec, error) {
+	var headers sql.NullString
+	err := db.QueryRow("SELECT headers FROM sys_meta_rpt WHERE id = ?", id).Scan(&headers)
+	if err != nil {
+		return map[string]structs.ColumnSpec{}, err
 	}
+	return utils.ParseColumnSpecs(headers.String), nil
+}
 
-	rows, err := db.Query(paginatedQuery)
+func GetChartSpecByID(db *sql.DB, id int) (*structs.ChartSpec, error) {
+	var graph sql.NullString
+	err := db.QueryRow("SELECT graph FROM sys_meta_rpt WHERE id = ?", id).Scan(&graph)
 	if err != nil {
-		log.Printf("Error executing query: %v\n", err)
 		return nil, err
 	}
+	return utils.ParseChartSpec(graph.String)
+}
+
+func ExecuteQuery(db *sql.DB, rq ReportQuery, havingClause string, offset, limit int) ([]map[string]interface{}, error) {
+	results, _, err := ExecuteQueryWithColumns(db, rq, havingClause, offset, limit)
+	return results, err
+}
+
+func ExecuteQueryWithColumns(db *sql.DB, rq ReportQuery, havingClause string, offset, limit int) ([]map[string]interface{}, []utils.Column, error) {
+	return querySQL(db, reportSubquery(rq, havingClause), offset, limit)
+}
+
+func querySQL(db *sql.DB, sourceSQL string, offset, limit int) ([]map[string]interface{}, []utils.Column, error) {
+	return querySQLContext(context.Background(), db, sourceSQL, offset, limit)
+}
+
+func querySQLContext(ctx context.Context, db *sql.DB, sourceSQL string, offset, limit int) ([]map[string]interface{}, []utils.Column, error) {
+	paginatedQuery := fmt.Sprintf("%s LIMIT %d OFFSET %d", sourceSQL, limit, offset)
+
+	rows, err := db.QueryContext(ctx, paginatedQuery)
+	if err != nil {
+		log.Printf("Error executing query: %v\n", err)
+		return nil, nil, err
+	}
 	defer rows.Close()
 
-	cols, err := rows.Columns()
+	colTypes, err := rows.ColumnTypes()
 	if err != nil {
 		log.Printf("Error getting columns: %v\n", err)
-		return nil, err
+		return nil, nil, err
+	}
+
+	cols := make([]utils.Column, len(colTypes))
+	for i, colType := range colTypes {
+		cols[i] = utils.Column{Name: colType.Name(), DatabaseType: colType.DatabaseTypeName()}
 	}
 
 	results := make([]map[string]interface{}, 0)
@@ -146,52 +230,72 @@ func ExecuteQuery(db *sql.DB, query, whereClause, havingClause string, offset, l
 
 		if err := rows.Scan(columnPointers...); err != nil {
 			log.Printf("Error scanning row: %v\n", err)
-			return nil, err
+			return nil, nil, err
 		}
 
 		m := make(map[string]interface{})
-		for i, colName := range cols {
+		for i, col := range cols {
 			val := columnPointers[i].(*interface{})
 			processedValue, err := utils.ProcessValue(*val)
 			if err != nil {
 				log.Printf("Error processing value: %v\n", err)
-				return nil, err
+				return nil, nil, err
 			}
-			m[colName] = processedValue
+			m[col.Name] = processedValue
 		}
 		results = append(results, m)
 	}
 
 	if err = rows.Err(); err != nil {
 		log.Printf("Error in rows: %v\n", err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return results, nil
+	return results, cols, nil
+}
+
+func GetTotalRows(db *sql.DB, rq ReportQuery, havingClause string) (int, error) {
+	return countSQL(db, reportSubquery(rq, havingClause))
 }
 
-func GetTotalRows(db *sql.DB, query, whereClause, havingClause string) (int, error) {
+func countSQL(db *sql.DB, sourceSQL string) (int, error) {
 	var totalRows int
-	var countQuery string
-	if havingClause == "" {
-		countQuery = fmt.Sprintf("SELECT COUNT(*) FROM (%s WHERE %s) AS count_query", query, whereClause)
-	} else {
-		countQuery = fmt.Sprintf("SELECT COUNT(*) FROM (%s WHERE %s HAVING %s) AS count_query", query, whereClause, havingClause)
-	}
+	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS count_query", sourceSQL)
 	row := db.QueryRow(countQuery)
 	err := row.Scan(&totalRows)
 	return totalRows, err
 }
 
-func buildHavingClause(filters map[string]string) string {
+// reportSubquery builds the SQL every report path runs. Row policies wrap
+// the filtered report from outside, so filters can only narrow what they
+// allow.
+func reportSubquery(rq ReportQuery, havingClause string) string {
+	source := fmt.Sprintf("%s WHERE %s", rq.Query, rq.Where)
+	if havingClause != "" {
+		source = fmt.Sprintf("%s HAVING %s", source, havingClause)
+	}
+	if len(rq.Policies) == 0 {
+		return source
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS rls_data WHERE (%s)", source, strings.Join(rq.Policies, ") AND ("))
+}
+
+// buildHavingClause turns the request filters into substring matches.
+// Keys must be plain column names and values are quoted, so a filter can't
+// reach outside its own condition.
+func buildHavingClause(filters map[string]string) (string, error) {
 	if len(filters) == 0 {
-		return ""
+		return "", nil
 	}
 
 	var filterConditions []string
 	for key, value := range filters {
-		filterConditions = append(filterConditions, fmt.Sprintf("%s LIKE '%%%s%%'", key, value))
+		column, err := quoteIdentifier(key)
+		if err != nil {
+			return "", invalidf("invalid filter: %v", err)
+		}
+		filterConditions = append(filterConditions, fmt.Sprintf("%s LIKE %s", column, sqlLiteral("%"+value+"%")))
 	}
 
-	return strings.Join(filterConditions, " AND ")
+	return strings.Join(filterConditions, " AND "), nil
 }
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var userVariable = regexp.MustCompile(`:user\.([A-Za-z_][A-Za-z0-9_]*)\b`)
+
+// loadRowPolicies returns the report's row-level security rules with their
+// :user.* variables resolved for scope.
+func loadRowPolicies(db *sql.DB, reportID int, scope QueryScope) ([]string, error) {
+	rows, err := db.Query("SELECT predicate FROM sys_rls_rule WHERE report_id = ? ORDER BY id", reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var predicates []string
+	for rows.Next() {
+		var predicate string
+		if err := rows.Scan(&predicate); err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, predicate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(predicates) == 0 {
+		return nil, nil
+	}
+
+	attributes, err := userAttributes(db, scope)
+	if err != nil {
+		return nil, err
+	}
+	for i, predicate := range predicates {
+		predicates[i] = bindUserVariables(predicate, attributes)
+	}
+	return predicates, nil
+}
+
+// userAttributes collects what :user.* can refer to: the user's id,
+// username, email, role and active site, plus every row in
+// sys_user_attribute.
+func userAttributes(db *sql.DB, scope QueryScope) (map[string][]string, error) {
+	var id uint
+	var email, role sql.NullString
+	err := db.QueryRow("SELECT id, email, role FROM sys_user WHERE username = ?", scope.Username).Scan(&id, &email, &role)
+	if err != nil {
+		return nil, fmt.Errorf("error loading user attributes: %v", err)
+	}
+
+	attributes := map[string][]string{
+		"id":       {strconv.FormatUint(uint64(id), 10)},
+		"username": {scope.Username},
+		"email":    {email.String},
+		"role":     {role.String},
+		"site_id":  {strconv.FormatUint(uint64(scope.SiteID), 10)},
+	}
+
+	rows, err := db.Query("SELECT name, value FROM sys_user_attribute WHERE user_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, fmt.Errorf("error loading user attributes: %v", err)
+	}
+	defer rows.Close()
+	custom := map[string][]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		custom[name] = append(custom[name], value)
+	}
+	// Custom attributes can't shadow the built-in ones.
+	for name, values := range custom {
+		if _, builtin := attributes[name]; !builtin {
+			attributes[name] = values
+		}
+	}
+	return attributes, rows.Err()
+}
+
+// bindUserVariables replaces each :user.<name> with the attribute's values
+// as a comma-separated list of string literals. Unknown attributes become
+// NULL, so a rule that reads them matches no rows.
+func bindUserVariables(predicate string, attributes map[string][]string) string {
+	return userVariable.ReplaceAllStringFunc(predicate, func(match string) string {
+		values := attributes[userVariable.FindStringSubmatch(match)[1]]
+		if len(values) == 0 {
+			return "NULL"
+		}
+		literals := make([]string, len(values))
+		for i, value := range values {
+			literals[i] = sqlLiteral(value)
+		}
+		return strings.Join(literals, ", ")
+	})
+}
+
+// sqlLiteral quotes value as a MySQL string literal. Backslashes are
+// doubled as well as quotes, so the literal can't be closed early whether
+// or not NO_BACKSLASH_ESCAPES is set.
+func sqlLiteral(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `''`)
+	return "'" + value + "'"
+}
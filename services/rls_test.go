@@ -0,0 +1,149 @@
+package services
+
+import (
+	"database/sql"
+	"go-report-management/structs"
+	"strings"
+	"testing"
+)
+
+func TestSQLLiteral(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain", "north", `'north'`},
+		{"empty", "", `''`},
+		{"quote", "o'brien", `'o''brien'`},
+		{"closing attempt", "x' OR '1'='1", `'x'' OR ''1''=''1'`},
+		{"backslash", `a\b`, `'a\\b'`},
+		// With backslash escapes on, \' would otherwise close the literal.
+		{"backslash quote", `\'`, `'\\'''`},
+		{"trailing backslash", `x\`, `'x\\'`},
+		{"nul", "a\x00b", "'a\x00b'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sqlLiteral(tt.value); got != tt.want {
+				t.Fatalf("sqlLiteral(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindUserVariables(t *testing.T) {
+	attributes := map[string][]string{
+		"username": {"alice"},
+		"regions":  {"north", "o'south"},
+	}
+	tests := []struct {
+		predicate string
+		want      string
+	}{
+		{"owner = :user.username", "owner = 'alice'"},
+		{"region IN (:user.regions)", "region IN ('north', 'o''south')"},
+		// Unknown attributes match nothing rather than failing the query.
+		{"region IN (:user.missing)", "region IN (NULL)"},
+		{":user.username_x = 1", "NULL = 1"},
+	}
+	for _, tt := range tests {
+		if got := bindUserVariables(tt.predicate, attributes); got != tt.want {
+			t.Errorf("bindUserVariables(%q) = %q, want %q", tt.predicate, got, tt.want)
+		}
+	}
+}
+
+func TestReportSubqueryAppliesPoliciesOutsideFilters(t *testing.T) {
+	rq := ReportQuery{Query: "SELECT region FROM sales", Where: "1 = 1", Policies: []string{"region = 'north'", "amount > 0"}}
+	got := reportSubquery(rq, "region LIKE '%' OR 1=1")
+	want := "SELECT * FROM (SELECT region FROM sales WHERE 1 = 1 HAVING region LIKE '%' OR 1=1) AS rls_data WHERE (region = 'north') AND (amount > 0)"
+	if got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+}
+
+// newRLSTest returns a database with a sales report and a user of it.
+func newRLSTest(t *testing.T) (*sql.DB, structs.SysUser, int) {
+	t.Helper()
+	gormDB := newTestDB(t)
+	if err := gormDB.AutoMigrate(&structs.SysMetaRpt{}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := gormDB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE sales (region TEXT, amount INTEGER)",
+		"INSERT INTO sales VALUES ('north', 10), ('south', 20), ('east', 30)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := structs.SysMetaRpt{Name: "sales", Query: "SELECT region, amount FROM sales", Where: "1 = 1"}
+	gormDB.Create(&report)
+	gormDB.Create(&structs.SysRlsRule{ReportID: report.ID, Predicate: "region IN (:user.region)"})
+	user := structs.SysUser{Username: "alice", Email: "alice@example.com", Role: structs.RoleUser, Active: true}
+	gormDB.Create(&user)
+	return db, user, int(report.ID)
+}
+
+func regionsOf(t *testing.T, db *sql.DB, reportID int, scope QueryScope) []string {
+	t.Helper()
+	results, err := GetReportDataPaginated(db, scope, reportID, 100, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var regions []string
+	for _, row := range results {
+		regions = append(regions, row["region"].(string))
+	}
+	return regions
+}
+
+func TestRowPolicies(t *testing.T) {
+	db, user, reportID := newRLSTest(t)
+	scope := QueryScope{Username: user.Username}
+	addAttribute := func(name, value string) {
+		if _, err := db.Exec("INSERT INTO sys_user_attribute (user_id, name, value) VALUES (?, ?, ?)", user.ID, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := regionsOf(t, db, reportID, scope); len(got) != 0 {
+		t.Fatalf("no region attribute: got rows %v, want none", got)
+	}
+
+	addAttribute("region", "north")
+	if got := strings.Join(regionsOf(t, db, reportID, scope), ","); got != "north" {
+		t.Fatalf("one region: got %q", got)
+	}
+
+	addAttribute("region", "south")
+	if got := strings.Join(regionsOf(t, db, reportID, scope), ","); got != "north,south" {
+		t.Fatalf("two regions: got %q", got)
+	}
+}
+
+func TestUserAttributesCantShadowBuiltins(t *testing.T) {
+	db, user, _ := newRLSTest(t)
+	for _, name := range []string{"username", "role", "site_id"} {
+		if _, err := db.Exec("INSERT INTO sys_user_attribute (user_id, name, value) VALUES (?, ?, ?)", user.ID, name, "forged"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attributes, err := userAttributes(db, QueryScope{Username: user.Username, SiteID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"username": "alice", "role": structs.RoleUser, "site_id": "7", "email": "alice@example.com"}
+	for name, value := range want {
+		if got := attributes[name]; len(got) != 1 || got[0] != value {
+			t.Errorf("%s = %v, want [%s]", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"go-report-management/structs"
+	"strings"
+	"testing"
+)
+
+func TestSigningKeysAreSealedAtRest(t *testing.T) {
+	db := newTestDB(t)
+	ring := useTestKeyRing(t, db)
+
+	var record structs.SysSigningKey
+	db.Where("retired_at IS NULL").First(&record)
+	if !strings.HasPrefix(record.PrivateKey, "-----BEGIN "+sealedKeyPEMType) {
+		t.Fatalf("private key stored as %.40q", record.PrivateKey)
+	}
+
+	// A row moved to another kid no longer decrypts.
+	record.Kid = "other"
+	if _, err := parseSigningKey(record, ring.sealer); err == nil {
+		t.Fatal("sealed key opened under another kid")
+	}
+}
+
+func TestPlaintextSigningKeysAreSealedOnSync(t *testing.T) {
+	db := newTestDB(t)
+	ring := useTestKeyRing(t, db)
+	token, err := GenerateJWT("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Store the active key the way it was before encryption at rest.
+	ring.mu.RLock()
+	active := ring.active
+	ring.mu.RUnlock()
+	der, err := x509.MarshalPKCS8PrivateKey(active.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	db.Model(&structs.SysSigningKey{}).Where("kid = ?", active.kid).Update("private_key", plaintext)
+
+	if err := ring.sync(); err != nil {
+		t.Fatal(err)
+	}
+	var record structs.SysSigningKey
+	db.Where("kid = ?", active.kid).First(&record)
+	if record.PrivateKey == plaintext {
+		t.Fatal("plaintext key left in place")
+	}
+	if _, err := parseClaims(token, TokenTypeAccess); err != nil {
+		t.Fatalf("token signed before sealing doesn't verify: %v", err)
+	}
+}
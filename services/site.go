@@ -0,0 +1,145 @@
+package services
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-report-management/structs"
+	"gorm.io/gorm"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+var (
+	ErrNotSiteMember  = fmt.Errorf("not a member of this site")
+	ErrReportNotFound = fmt.Errorf("report not found")
+)
+
+var siteIDParam = regexp.MustCompile(`:site_id\b`)
+
+// QueryScope is the principal a report query runs for. Its SiteID comes
+// from the validated token, never from the request, and fills the
+// report's :site_id parameter.
+type QueryScope struct {
+	Username string
+	SiteID   uint
+}
+
+// ScopeFrom returns the scope AuthenticateJWT stored for the request.
+func ScopeFrom(c *gin.Context) QueryScope {
+	return QueryScope{Username: c.GetString("username"), SiteID: c.GetUint("site_id")}
+}
+
+// ReportInSite reports whether report is visible from siteID. Reports
+// without a site are shared by every site.
+func ReportInSite(report structs.SysMetaRpt, siteID uint) bool {
+	return report.SiteID == nil || *report.SiteID == siteID
+}
+
+// CanWriteReport reports whether the request may change report: it has to
+// belong to the active site, and shared reports need report:admin on every
+// report.
+func CanWriteReport(c *gin.Context, report structs.SysMetaRpt) bool {
+	if report.SiteID == nil {
+		return PermissionsFrom(c).Has(structs.PermReportAdmin)
+	}
+	return *report.SiteID == c.GetUint("site_id")
+}
+
+// bindSiteParam replaces :site_id in report SQL with the scope's site.
+// The value is an unsigned integer, so it can't change the statement.
+func bindSiteParam(sql string, scope QueryScope) string {
+	return siteIDParam.ReplaceAllString(sql, strconv.FormatUint(uint64(scope.SiteID), 10))
+}
+
+// resolveSite picks the active site for userID: requested if the user is a
+// member of it, otherwise the default membership, then the lowest site ID.
+// Users without memberships get site 0, which only sees shared reports.
+func resolveSite(db *gorm.DB, userID, requested uint) (uint, error) {
+	var memberships []structs.SysUserSite
+	if err := db.Where("user_id = ?", userID).Order("site_id").Find(&memberships).Error; err != nil {
+		return 0, err
+	}
+
+	if requested != 0 {
+		for _, m := range memberships {
+			if m.SiteID == requested {
+				return requested, nil
+			}
+		}
+		return 0, ErrNotSiteMember
+	}
+	if len(memberships) == 0 {
+		return 0, nil
+	}
+	for _, m := range memberships {
+		if m.IsDefault {
+			return m.SiteID, nil
+		}
+	}
+	return memberships[0].SiteID, nil
+}
+
+func isSiteMember(db *gorm.DB, userID, siteID uint) (bool, error) {
+	if siteID == 0 {
+		return true, nil
+	}
+	var count int64
+	err := db.Model(&structs.SysUserSite{}).Where("user_id = ? AND site_id = ?", userID, siteID).Count(&count).Error
+	return count > 0, err
+}
+
+// SwitchSite issues a new token pair for another site the user belongs to.
+func SwitchSite(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		SiteID uint `json:"site_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user structs.SysUser
+	if err := db.Where("username = ?", c.GetString("username")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	siteID, err := resolveSite(db, user.ID, req.SiteID)
+	if err == ErrNotSiteMember {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this site"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokenString, err := GenerateJWT(user.Username, siteID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+	refreshToken, err := GenerateRefreshJWT(db, &user, siteID, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": tokenString, "refresh_token": refreshToken, "site_id": siteID})
+}
+
+// ListOwnSites returns the sites the authenticated user belongs to.
+func ListOwnSites(c *gin.Context, db *gorm.DB) {
+	var user structs.SysUser
+	if err := db.Where("username = ?", c.GetString("username")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var memberships []structs.SysUserSite
+	if err := db.Where("user_id = ?", user.ID).Order("site_id").Find(&memberships).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"active_site_id": c.GetUint("site_id"), "sites": memberships})
+}
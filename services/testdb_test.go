@@ -0,0 +1,51 @@
+package services
+
+import (
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"go-report-management/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	// Cheap hashing, and no .env lookup from currentPasswordPolicy.
+	passwordPolicyOnce.Do(func() {
+		passwordPolicy = PasswordPolicy{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+	})
+}
+
+// newTestDB returns a migrated SQLite database private to t.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+	return db
+}
+
+// useTestKeyRing points token signing at a fresh key ring in db.
+func useTestKeyRing(t *testing.T, db *gorm.DB) *KeyRing {
+	t.Helper()
+	sealer, err := newKeySealer(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := &KeyRing{db: db, alg: "EdDSA", rotation: time.Hour, sealer: sealer, keys: make(map[string]*signingKey)}
+	if err := ring.sync(); err != nil {
+		t.Fatalf("init key ring: %v", err)
+	}
+	previous := keyRing
+	keyRing = ring
+	t.Cleanup(func() { keyRing = previous })
+	return ring
+}
@@ -0,0 +1,29 @@
+package structs
+
+import (
+	"time"
+)
+
+// SysApiKey is a long-lived credential for services. Only the SHA-256 of
+// the key is stored; Prefix identifies it in lists and logs. The key acts
+// as UserID on SiteID, narrowed to Scopes and, if set, ReportIDs.
+type SysApiKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Prefix     string     `gorm:"size:16;uniqueIndex" json:"prefix"`
+	Hash       string     `gorm:"size:64" json:"-"`
+	Name       string     `gorm:"size:100" json:"name"`
+	UserID     uint       `gorm:"index" json:"user_id"`
+	SiteID     uint       `json:"site_id"`
+	Scopes     string     `gorm:"size:255" json:"scopes"`
+	ReportIDs  string     `gorm:"type:text" json:"report_ids"`
+	AllowedIPs string     `gorm:"type:text" json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `gorm:"size:45" json:"last_used_ip"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (SysApiKey) TableName() string {
+	return "sys_api_key"
+}
@@ -0,0 +1,18 @@
+package structs
+
+// ChartSpec is the chart definition stored in SysMetaRpt.Graph, e.g.
+// {"type": "bar", "category": "month", "series": [{"column": "total"}], "title": "Sales"}.
+// Each series is aggregated per category with its Aggregate: sum (the
+// default), avg, count, min or max.
+type ChartSpec struct {
+	Type     string        `json:"type"`
+	Category string        `json:"category"`
+	Series   []ChartSeries `json:"series"`
+	Title    string        `json:"title"`
+}
+
+type ChartSeries struct {
+	Column    string `json:"column"`
+	Name      string `json:"name"`
+	Aggregate string `json:"aggregate"`
+}
@@ -0,0 +1,23 @@
+package structs
+
+// ColumnSpec describes how a single report column is rendered. A report's
+// Headers field holds a JSON array of these.
+type ColumnSpec struct {
+	Name        string            `json:"name"`
+	Label       string            `json:"label"`
+	Format      string            `json:"format"`
+	Width       float64           `json:"width"`
+	Total       string            `json:"total"`
+	Conditional []ConditionalRule `json:"conditional"`
+}
+
+// ConditionalRule highlights cells whose value matches Criteria, e.g.
+// {"criteria": "<", "value": "0", "font_color": "#9C0006"}.
+type ConditionalRule struct {
+	Criteria  string `json:"criteria"`
+	Value     string `json:"value"`
+	MinValue  string `json:"min_value"`
+	MaxValue  string `json:"max_value"`
+	FontColor string `json:"font_color"`
+	FillColor string `json:"fill_color"`
+}
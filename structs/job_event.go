@@ -0,0 +1,19 @@
+package structs
+
+import (
+	"time"
+)
+
+// SysJobEvent carries a job event between replicas when EVENT_BROKER is
+// mysql. The id is the event's sequence number and rows are pruned after
+// WS_REPLAY_RETENTION.
+type SysJobEvent struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement;index:idx_sys_job_event_user,priority:2"`
+	Username  string    `gorm:"size:100;not null;index:idx_sys_job_event_user,priority:1"`
+	Payload   string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"type:datetime;not null;default:CURRENT_TIMESTAMP;index:idx_sys_job_event_created"`
+}
+
+func (SysJobEvent) TableName() string {
+	return "sys_job_event"
+}
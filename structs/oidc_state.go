@@ -0,0 +1,22 @@
+package structs
+
+import (
+	"time"
+)
+
+// SysOidcState is a pending OpenID Connect login, kept between the
+// redirect to the identity provider and its callback. It lives in the
+// database so the callback may land on any replica, and is deleted when
+// used.
+type SysOidcState struct {
+	State        string `gorm:"size:64;primaryKey"`
+	Nonce        string `gorm:"size:64"`
+	CodeVerifier string `gorm:"size:128"`
+	SiteID       uint
+	CreatedAt    time.Time
+	ExpiresAt    time.Time `gorm:"index"`
+}
+
+func (SysOidcState) TableName() string {
+	return "sys_oidc_state"
+}
@@ -0,0 +1,55 @@
+package structs
+
+const (
+	PermReportView   = "report:view"
+	PermReportRun    = "report:run"
+	PermReportExport = "report:export"
+	PermReportEdit   = "report:edit"
+	PermReportAdmin  = "report:admin"
+)
+
+// SysRole is a named set of report permissions, stored comma-separated,
+// e.g. "report:view,report:run".
+type SysRole struct {
+	ID          uint
+	Name        string `gorm:"size:100;uniqueIndex"`
+	Permissions string `gorm:"size:255"`
+}
+
+func (SysRole) TableName() string {
+	return "sys_role"
+}
+
+type SysGroup struct {
+	ID   uint
+	Name string `gorm:"size:100;uniqueIndex"`
+}
+
+func (SysGroup) TableName() string {
+	return "sys_group"
+}
+
+type SysGroupMember struct {
+	GroupID uint `gorm:"primaryKey"`
+	UserID  uint `gorm:"primaryKey;index"`
+}
+
+func (SysGroupMember) TableName() string {
+	return "sys_group_member"
+}
+
+// SysRoleGrant gives a role to a user or a group. A grant with ReportID
+// applies to that report only, one with Module to every report in the
+// module, and one with neither to every report.
+type SysRoleGrant struct {
+	ID       uint
+	RoleID   uint   `gorm:"index"`
+	UserID   *uint  `gorm:"index"`
+	GroupID  *uint  `gorm:"index"`
+	Module   string `gorm:"size:100"`
+	ReportID *uint
+}
+
+func (SysRoleGrant) TableName() string {
+	return "sys_role_grant"
+}
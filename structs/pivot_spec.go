@@ -0,0 +1,10 @@
+package structs
+
+// PivotSpec describes a cross-tab, e.g.
+// {"rows": ["product"], "column": "month", "value": "amount", "aggregate": "sum"}.
+type PivotSpec struct {
+	Rows      []string `json:"rows"`
+	Column    string   `json:"column"`
+	Value     string   `json:"value"`
+	Aggregate string   `json:"aggregate"`
+}
@@ -0,0 +1,23 @@
+package structs
+
+import (
+	"time"
+)
+
+// SysRefreshToken is the server-side record of an issued refresh token,
+// keyed by its jti. Every rotation stays in the family of the login that
+// started it, so reuse of a spent token can revoke the whole chain.
+type SysRefreshToken struct {
+	ID        string `gorm:"size:36;primaryKey"`
+	FamilyID  string `gorm:"size:36;index"`
+	UserID    uint   `gorm:"index"`
+	SiteID    uint
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+func (SysRefreshToken) TableName() string {
+	return "sys_refresh_token"
+}
@@ -0,0 +1,28 @@
+package structs
+
+// SysRlsRule is a row-level security predicate over a report's output
+// columns, e.g. "region IN (:user.regions)". Every rule of a report applies
+// to every query run from it.
+type SysRlsRule struct {
+	ID          uint
+	ReportID    uint   `gorm:"index"`
+	Predicate   string `gorm:"type:text"`
+	Description string `gorm:"size:255"`
+}
+
+func (SysRlsRule) TableName() string {
+	return "sys_rls_rule"
+}
+
+// SysUserAttribute is one value of a user attribute that rules read as
+// :user.<name>. An attribute with several rows expands to a list.
+type SysUserAttribute struct {
+	ID     uint
+	UserID uint   `gorm:"index"`
+	Name   string `gorm:"size:100"`
+	Value  string `gorm:"size:255"`
+}
+
+func (SysUserAttribute) TableName() string {
+	return "sys_user_attribute"
+}
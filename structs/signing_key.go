@@ -0,0 +1,22 @@
+package structs
+
+import (
+	"time"
+)
+
+// SysSigningKey is one of the keys tokens are signed with. The newest key
+// that isn't retired signs; retired keys stay published in the JWKS until
+// every token they signed has expired. PrivateKey is a PEM block encrypted
+// with JWT_KEY_ENCRYPTION_KEY.
+type SysSigningKey struct {
+	Kid        string `gorm:"size:64;primaryKey"`
+	Alg        string `gorm:"size:10"`
+	PrivateKey string `gorm:"type:text" json:"-"`
+	PublicKey  string `gorm:"type:text"`
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+}
+
+func (SysSigningKey) TableName() string {
+	return "sys_signing_key"
+}
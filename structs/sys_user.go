@@ -1,9 +1,40 @@
 package structs
 
+import (
+	"time"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// Where a user's password is checked. Directory users are only ever
+// authenticated by their directory, even if a local password is set.
+const (
+	AuthSourceLocal = "local"
+	AuthSourceLDAP  = "ldap"
+	AuthSourceOIDC  = "oidc"
+)
+
 type SysUser struct {
-	ID       uint
-	Username string
-	Password string
+	ID                 uint
+	Username           string
+	Password           string `gorm:"size:255" json:"-"`
+	Email              string `gorm:"size:255"`
+	DisplayName        string `gorm:"size:100"`
+	Role               string `gorm:"size:30;default:user"`
+	Active             bool   `gorm:"not null;default:true"`
+	MustChangePassword bool
+	CreatedAt          time.Time
+	LastLoginAt        *time.Time
+	// Tokens issued before SessionsRevokedAt are rejected, which is how
+	// "log out all sessions" reaches access tokens too.
+	SessionsRevokedAt *time.Time `json:"-"`
+	// OidcSubject is the "sub" of the identity provider account linked to
+	// this user, if any.
+	OidcSubject *string `gorm:"size:255;uniqueIndex"`
+	AuthSource  string  `gorm:"size:20;default:local"`
 }
 
 func (SysUser) TableName() string {
@@ -0,0 +1,13 @@
+package structs
+
+// SysUserSite makes a user a member of a site. Login picks the default
+// membership as the active site when the client doesn't ask for one.
+type SysUserSite struct {
+	UserID    uint `gorm:"primaryKey"`
+	SiteID    uint `gorm:"primaryKey;index"`
+	IsDefault bool
+}
+
+func (SysUserSite) TableName() string {
+	return "sys_user_site"
+}
@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"go-report-management/structs"
+	"strconv"
+	"strings"
+)
+
+const (
+	chartSheetName     = "Chart"
+	chartDataSheetName = "Chart Data"
+	// maxChartCategories matches the cap of the chart endpoint; rows of
+	// further categories are left out of the chart.
+	maxChartCategories = 500
+)
+
+var chartAggregates = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"count": true,
+	"min":   true,
+	"max":   true,
+}
+
+var chartTypes = map[string]excelize.ChartType{
+	"bar":            excelize.Col,
+	"column":         excelize.Col,
+	"horizontal_bar": excelize.Bar,
+	"line":           excelize.Line,
+	"pie":            excelize.Pie,
+	"area":           excelize.Area,
+}
+
+func ParseChartSpec(graph string) (*structs.ChartSpec, error) {
+	graph = strings.TrimSpace(graph)
+	if graph == "" {
+		return nil, nil
+	}
+
+	var spec structs.ChartSpec
+	if err := json.Unmarshal([]byte(graph), &spec); err != nil {
+		return nil, fmt.Errorf("invalid chart definition: %v", err)
+	}
+	if _, ok := chartTypes[strings.ToLower(spec.Type)]; !ok {
+		return nil, fmt.Errorf("unsupported chart type: %s", spec.Type)
+	}
+	if spec.Category == "" || len(spec.Series) == 0 {
+		return nil, fmt.Errorf("chart definition needs a category and at least one series")
+	}
+	for i, series := range spec.Series {
+		aggregate := strings.ToLower(series.Aggregate)
+		if aggregate == "" {
+			aggregate = "sum"
+		}
+		if !chartAggregates[aggregate] {
+			return nil, fmt.Errorf("unsupported chart aggregate: %s", series.Aggregate)
+		}
+		spec.Series[i].Aggregate = aggregate
+	}
+	return &spec, nil
+}
+
+// chartGroup accumulates the rows of one category, one chartValue per
+// series.
+type chartGroup struct {
+	label  interface{}
+	values []chartValue
+}
+
+type chartValue struct {
+	count    int
+	numbers  int
+	sum      float64
+	min, max float64
+}
+
+func (v *chartValue) add(val interface{}) {
+	if val == nil {
+		return
+	}
+	v.count++
+	n, ok := chartNumber(val)
+	if !ok {
+		return
+	}
+	if v.numbers == 0 || n < v.min {
+		v.min = n
+	}
+	if v.numbers == 0 || n > v.max {
+		v.max = n
+	}
+	v.numbers++
+	v.sum += n
+}
+
+func (v *chartValue) result(aggregate string) interface{} {
+	if aggregate == "count" {
+		return v.count
+	}
+	if v.numbers == 0 {
+		return nil
+	}
+	switch aggregate {
+	case "avg":
+		return v.sum / float64(v.numbers)
+	case "min":
+		return v.min
+	case "max":
+		return v.max
+	}
+	return v.sum
+}
+
+func chartNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// collectChartRow adds a written row to its category's group, so the chart
+// plots one aggregated point per category like the chart endpoint does.
+func (w *ExcelWriter) collectChartRow(result map[string]interface{}) {
+	label := result[w.Chart.Category]
+	key := fmt.Sprint(label)
+	group, ok := w.chartIndex[key]
+	if !ok {
+		if len(w.chartGroups) >= maxChartCategories {
+			return
+		}
+		group = &chartGroup{label: label, values: make([]chartValue, len(w.Chart.Series))}
+		w.chartIndex[key] = group
+		w.chartGroups = append(w.chartGroups, group)
+	}
+	for i, series := range w.Chart.Series {
+		group.values[i].add(result[series.Column])
+	}
+}
+
+// addChartSheet writes the aggregated groups to a data sheet and draws the
+// chart over it.
+func (w *ExcelWriter) addChartSheet() error {
+	if w.Chart == nil || len(w.chartGroups) == 0 {
+		return nil
+	}
+
+	categoryCol, ok := w.column(w.Chart.Category)
+	if !ok {
+		return fmt.Errorf("chart category column %s not found", w.Chart.Category)
+	}
+	header := []string{w.headerLabel(categoryCol)}
+	for _, series := range w.Chart.Series {
+		column, ok := w.column(series.Column)
+		if !ok {
+			return fmt.Errorf("chart series column %s not found", series.Column)
+		}
+		label := series.Name
+		if label == "" {
+			label = w.headerLabel(column)
+		}
+		header = append(header, label)
+	}
+
+	if _, err := w.File.NewSheet(chartDataSheetName); err != nil {
+		return err
+	}
+	WriteHeaders(w.File, header, chartDataSheetName)
+	for i, group := range w.chartGroups {
+		row := []interface{}{group.label}
+		for j, series := range w.Chart.Series {
+			row = append(row, group.values[j].result(series.Aggregate))
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		if err := w.File.SetSheetRow(chartDataSheetName, cell, &row); err != nil {
+			return err
+		}
+	}
+
+	chart := &excelize.Chart{
+		Type:   chartTypes[strings.ToLower(w.Chart.Type)],
+		Legend: excelize.ChartLegend{Position: "bottom"},
+	}
+	if w.Chart.Title != "" {
+		chart.Title = []excelize.RichTextRun{{Text: w.Chart.Title}}
+	}
+	lastRow := len(w.chartGroups) + 1
+	for i := range w.Chart.Series {
+		valueCol, _ := excelize.ColumnNumberToName(i + 2)
+		chart.Series = append(chart.Series, excelize.ChartSeries{
+			Name:       fmt.Sprintf("'%s'!$%s$1", chartDataSheetName, valueCol),
+			Categories: fmt.Sprintf("'%s'!$A$2:$A$%d", chartDataSheetName, lastRow),
+			Values:     fmt.Sprintf("'%s'!$%s$2:$%s$%d", chartDataSheetName, valueCol, valueCol, lastRow),
+		})
+	}
+
+	return w.File.AddChartSheet(chartSheetName, chart)
+}
+
+func (w *ExcelWriter) column(name string) (Column, bool) {
+	for _, column := range w.Columns {
+		if column.Name == name {
+			return column, true
+		}
+	}
+	return Column{}, false
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"encoding/json"
+	"go-report-management/structs"
+	"strings"
+)
+
+func ParseColumnSpecs(headers string) map[string]structs.ColumnSpec {
+	specs := make(map[string]structs.ColumnSpec)
+	headers = strings.TrimSpace(headers)
+	if headers == "" || !strings.HasPrefix(headers, "[") {
+		return specs
+	}
+
+	var list []structs.ColumnSpec
+	if err := json.Unmarshal([]byte(headers), &list); err != nil {
+		return specs
+	}
+
+	for _, spec := range list {
+		if spec.Name != "" {
+			specs[spec.Name] = spec
+		}
+	}
+	return specs
+}
@@ -4,39 +4,413 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/xuri/excelize/v2"
+	"go-report-management/structs"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-func WriteHeaders(f *excelize.File, headers []string, sheetName string) {
-	for i, header := range headers {
-		col := string(rune('A' + i))
-		f.SetCellValue(sheetName, col+"1", header)
+const (
+	maxExcelRows     = 1048576
+	widthSampleRows  = 1000
+	minColumnWidth   = 8
+	maxColumnWidth   = 60
+	columnWidthExtra = 2
+)
+
+var totalFunctions = map[string]string{
+	"sum":   "SUM",
+	"avg":   "AVERAGE",
+	"count": "COUNTA",
+	"min":   "MIN",
+	"max":   "MAX",
+}
+
+var namedNumFmts = map[string]string{
+	"integer":  "#,##0",
+	"decimal":  "#,##0.00",
+	"currency": "\"$\"#,##0.00",
+	"percent":  "0.00%",
+	"date":     "yyyy-mm-dd",
+	"datetime": "yyyy-mm-dd hh:mm:ss",
+	"time":     "hh:mm:ss",
+}
+
+type Column struct {
+	Name         string
+	DatabaseType string
+}
+
+type ExcelWriter struct {
+	File        *excelize.File
+	Columns     []Column
+	Specs       map[string]structs.ColumnSpec
+	Chart       *structs.ChartSpec
+	Pivot       *structs.PivotSpec
+	SheetName   string
+	sheetIndex  int
+	rowIndex    int
+	sheets      []sheetRange
+	widths      []int
+	sampled     int
+	styles      map[string]int
+	chartIndex  map[string]*chartGroup
+	chartGroups []*chartGroup
+	// pivotRowKeys and pivotColumns are the distinct pivot row and column
+	// values, which size the pivot table.
+	pivotRowKeys map[string]bool
+	pivotColumns map[string]bool
+}
+
+type sheetRange struct {
+	name    string
+	lastRow int
+}
+
+func NewExcelWriter(specs map[string]structs.ColumnSpec) *ExcelWriter {
+	return &ExcelWriter{
+		File:         excelize.NewFile(),
+		Specs:        specs,
+		SheetName:    "Sheet1",
+		sheetIndex:   1,
+		styles:       make(map[string]int),
+		chartIndex:   make(map[string]*chartGroup),
+		pivotRowKeys: make(map[string]bool),
+		pivotColumns: make(map[string]bool),
 	}
 }
 
-func WriteResults(f *excelize.File, headers []string, results []map[string]interface{}, rowIndex, sheetIndex *int, sheetName *string) {
+func (w *ExcelWriter) WriteRows(columns []Column, results []map[string]interface{}) error {
+	if w.Columns == nil {
+		w.Columns = columns
+		if err := w.startSheet(); err != nil {
+			return err
+		}
+	}
+
 	for _, result := range results {
-		*rowIndex++
-		for colIdx, header := range headers {
-			col := string(rune('A' + colIdx))
-			cell := fmt.Sprintf("%s%d", col, *rowIndex)
-			value, err := ProcessValue(result[header])
+		if w.rowIndex >= maxExcelRows-1 {
+			w.sheetIndex++
+			w.SheetName = fmt.Sprintf("Sheet%d", w.sheetIndex)
+			if _, err := w.File.NewSheet(w.SheetName); err != nil {
+				return err
+			}
+			if err := w.startSheet(); err != nil {
+				return err
+			}
+		}
+
+		w.rowIndex++
+		w.sheets[len(w.sheets)-1].lastRow = w.rowIndex
+		row := make(map[string]interface{}, len(w.Columns))
+		for colIdx, column := range w.Columns {
+			cell, _ := excelize.CoordinatesToCellName(colIdx+1, w.rowIndex)
+			value := excelCellValue(column, result[column.Name])
+			row[column.Name] = value
+			if err := w.File.SetCellValue(w.SheetName, cell, value); err != nil {
+				return err
+			}
+			if w.sampled < widthSampleRows {
+				w.trackWidth(colIdx, fmt.Sprint(value))
+			}
+		}
+		if w.Chart != nil {
+			w.collectChartRow(row)
+		}
+		if w.Pivot != nil && len(w.sheets) == 1 {
+			w.collectPivotRow(row)
+		}
+		w.sampled++
+	}
+	return nil
+}
+
+// Finish applies the sheet-wide formatting that needs the final row count:
+// autofilter, column widths, conditional formats, the totals row and the
+// pivot and chart sheets.
+func (w *ExcelWriter) Finish() error {
+	if len(w.Columns) == 0 {
+		return nil
+	}
+	lastCol, _ := excelize.ColumnNumberToName(len(w.Columns))
+
+	for _, sheet := range w.sheets {
+		if err := w.File.AutoFilter(sheet.name, fmt.Sprintf("A1:%s%d", lastCol, sheet.lastRow), nil); err != nil {
+			return fmt.Errorf("error adding autofilter: %v", err)
+		}
+		if err := w.setColumnWidths(sheet.name); err != nil {
+			return err
+		}
+		if sheet.lastRow < 2 {
+			continue
+		}
+		if err := w.setConditionalFormats(sheet); err != nil {
+			return err
+		}
+		if err := w.writeTotals(sheet); err != nil {
+			return err
+		}
+	}
+
+	if err := w.addPivotSheet(); err != nil {
+		return fmt.Errorf("error adding pivot table: %v", err)
+	}
+	if err := w.addChartSheet(); err != nil {
+		return fmt.Errorf("error adding chart: %v", err)
+	}
+	return nil
+}
+
+func (w *ExcelWriter) trackWidth(colIdx int, text string) {
+	if n := len([]rune(text)); n > w.widths[colIdx] {
+		w.widths[colIdx] = n
+	}
+}
+
+func (w *ExcelWriter) setColumnWidths(sheetName string) error {
+	for colIdx, column := range w.Columns {
+		width := w.Specs[column.Name].Width
+		if width <= 0 {
+			width = float64(w.widths[colIdx] + columnWidthExtra)
+			if width < minColumnWidth {
+				width = minColumnWidth
+			} else if width > maxColumnWidth {
+				width = maxColumnWidth
+			}
+		}
+		col, _ := excelize.ColumnNumberToName(colIdx + 1)
+		if err := w.File.SetColWidth(sheetName, col, col, width); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *ExcelWriter) setConditionalFormats(sheet sheetRange) error {
+	for colIdx, column := range w.Columns {
+		rules := w.Specs[column.Name].Conditional
+		if len(rules) == 0 {
+			continue
+		}
+
+		opts := make([]excelize.ConditionalFormatOptions, 0, len(rules))
+		for _, rule := range rules {
+			style := &excelize.Style{}
+			if rule.FontColor != "" {
+				style.Font = &excelize.Font{Color: rule.FontColor}
+			}
+			if rule.FillColor != "" {
+				style.Fill = excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{rule.FillColor}}
+			}
+			styleID, err := w.File.NewConditionalStyle(style)
 			if err != nil {
-				value = fmt.Sprintf("error: %v", err)
+				return fmt.Errorf("error creating conditional style for column %s: %v", column.Name, err)
 			}
-			f.SetCellValue(*sheetName, cell, value)
+			opts = append(opts, excelize.ConditionalFormatOptions{
+				Type:     "cell",
+				Criteria: rule.Criteria,
+				Value:    rule.Value,
+				MinValue: rule.MinValue,
+				MaxValue: rule.MaxValue,
+				Format:   styleID,
+			})
+		}
+
+		col, _ := excelize.ColumnNumberToName(colIdx + 1)
+		rangeRef := fmt.Sprintf("%s2:%s%d", col, col, sheet.lastRow)
+		if err := w.File.SetConditionalFormat(sheet.name, rangeRef, opts); err != nil {
+			return fmt.Errorf("error adding conditional format to column %s: %v", column.Name, err)
+		}
+	}
+	return nil
+}
+
+func (w *ExcelWriter) writeTotals(sheet sheetRange) error {
+	totalsRow := sheet.lastRow + 1
+	hasTotals := false
+
+	for colIdx, column := range w.Columns {
+		fn, ok := totalFunctions[strings.ToLower(w.Specs[column.Name].Total)]
+		if !ok {
+			continue
+		}
+		hasTotals = true
+		cell, _ := excelize.CoordinatesToCellName(colIdx+1, totalsRow)
+		col, _ := excelize.ColumnNumberToName(colIdx + 1)
+		formula := fmt.Sprintf("%s(%s2:%s%d)", fn, col, col, sheet.lastRow)
+		if err := w.File.SetCellFormula(sheet.name, cell, formula); err != nil {
+			return fmt.Errorf("error writing total for column %s: %v", column.Name, err)
+		}
+
+		numFmt := w.columnNumFmt(column)
+		if fn == "COUNTA" {
+			numFmt = namedNumFmts["integer"]
+		}
+		styleID, err := w.totalStyle(numFmt)
+		if err != nil {
+			return err
+		}
+		if err := w.File.SetCellStyle(sheet.name, cell, cell, styleID); err != nil {
+			return err
+		}
+	}
+	if !hasTotals {
+		return nil
+	}
+
+	firstCell := fmt.Sprintf("A%d", totalsRow)
+	if formula, _ := w.File.GetCellFormula(sheet.name, firstCell); formula != "" {
+		return nil
+	}
+	styleID, err := w.totalStyle("")
+	if err != nil {
+		return err
+	}
+	w.File.SetCellValue(sheet.name, firstCell, "Total")
+	return w.File.SetCellStyle(sheet.name, firstCell, firstCell, styleID)
+}
+
+func (w *ExcelWriter) totalStyle(numFmt string) (int, error) {
+	key := "total:" + numFmt
+	if styleID, ok := w.styles[key]; ok {
+		return styleID, nil
+	}
+	style := &excelize.Style{Font: &excelize.Font{Bold: true}}
+	if numFmt != "" {
+		style.CustomNumFmt = &numFmt
+	}
+	styleID, err := w.File.NewStyle(style)
+	if err != nil {
+		return 0, err
+	}
+	w.styles[key] = styleID
+	return styleID, nil
+}
+
+func (w *ExcelWriter) startSheet() error {
+	headers := make([]string, len(w.Columns))
+	for i, column := range w.Columns {
+		headers[i] = w.headerLabel(column)
+	}
+	WriteHeaders(w.File, headers, w.SheetName)
+	w.rowIndex = 1
+	w.sheets = append(w.sheets, sheetRange{name: w.SheetName, lastRow: 1})
+	if w.widths == nil {
+		w.widths = make([]int, len(headers))
+		for i, header := range headers {
+			w.trackWidth(i, header)
+		}
+	}
+
+	for colIdx, column := range w.Columns {
+		numFmt := w.columnNumFmt(column)
+		if numFmt == "" {
+			continue
+		}
+		styleID, err := w.numFmtStyle(numFmt)
+		if err != nil {
+			return fmt.Errorf("error creating style for column %s: %v", column.Name, err)
+		}
+		col, _ := excelize.ColumnNumberToName(colIdx + 1)
+		if err := w.File.SetColStyle(w.SheetName, col, styleID); err != nil {
+			return err
+		}
+	}
+
+	headerStyle, err := w.headerStyle()
+	if err != nil {
+		return err
+	}
+	lastCol, _ := excelize.ColumnNumberToName(len(headers))
+	if err := w.File.SetCellStyle(w.SheetName, "A1", lastCol+"1", headerStyle); err != nil {
+		return err
+	}
+	return w.File.SetPanes(w.SheetName, &excelize.Panes{
+		Freeze:      true,
+		YSplit:      1,
+		TopLeftCell: "A2",
+		ActivePane:  "bottomLeft",
+	})
+}
+
+func (w *ExcelWriter) headerLabel(column Column) string {
+	if spec, ok := w.Specs[column.Name]; ok && spec.Label != "" {
+		return spec.Label
+	}
+	return column.Name
+}
+
+func (w *ExcelWriter) headerStyle() (int, error) {
+	if styleID, ok := w.styles["header"]; ok {
+		return styleID, nil
+	}
+	styleID, err := w.File.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true},
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"#D9E1F2"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	w.styles["header"] = styleID
+	return styleID, nil
+}
+
+func (w *ExcelWriter) columnNumFmt(column Column) string {
+	if spec, ok := w.Specs[column.Name]; ok && spec.Format != "" {
+		if numFmt, named := namedNumFmts[spec.Format]; named {
+			return numFmt
 		}
-		if *rowIndex >= 1048576 {
-			*sheetIndex++
-			*rowIndex = 1
-			*sheetName = fmt.Sprintf("Sheet%d", *sheetIndex)
-			f.NewSheet(*sheetName)
-			WriteHeaders(f, headers, *sheetName)
+		return spec.Format
+	}
+
+	switch column.DatabaseType {
+	case "DATE":
+		return namedNumFmts["date"]
+	case "DATETIME", "TIMESTAMP":
+		return namedNumFmts["datetime"]
+	}
+	return ""
+}
+
+func (w *ExcelWriter) numFmtStyle(numFmt string) (int, error) {
+	if styleID, ok := w.styles[numFmt]; ok {
+		return styleID, nil
+	}
+	styleID, err := w.File.NewStyle(&excelize.Style{CustomNumFmt: &numFmt})
+	if err != nil {
+		return 0, err
+	}
+	w.styles[numFmt] = styleID
+	return styleID, nil
+}
+
+// excelCellValue types a value from the report query by its column's
+// database type, so numbers and dates land in Excel as such. DECIMAL and
+// NUMERIC become floats here, the only place their exact strings aren't
+// wanted: Excel stores doubles anyway.
+func excelCellValue(column Column, val interface{}) interface{} {
+	value, err := ConvertColumnValue(val, column.DatabaseType)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	switch strings.TrimPrefix(column.DatabaseType, "UNSIGNED ") {
+	case "DECIMAL", "NUMERIC":
+		if s, ok := value.(string); ok {
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				return n
+			}
 		}
 	}
-	results = nil
+	return value
+}
+
+func WriteHeaders(f *excelize.File, headers []string, sheetName string) {
+	for i, header := range headers {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(sheetName, cell, header)
+	}
 }
 
 func SaveExcelFile(f *excelize.File, reportID int) (string, error) {
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"github.com/xuri/excelize/v2"
+	"testing"
+)
+
+// The JSON API sends what ProcessValue makes of the driver's text values;
+// only the Excel writer types them.
+func TestReportValuesStayStringsOutsideExcel(t *testing.T) {
+	for _, raw := range []string{"42", "12345678901234567.89", "2024-03-01 10:00:00"} {
+		got, err := ProcessValue([]byte(raw))
+		if err != nil || got != raw {
+			t.Errorf("ProcessValue(%q) = %#v, %v", raw, got, err)
+		}
+	}
+}
+
+func TestExcelWriterTypesCells(t *testing.T) {
+	columns := []Column{{"qty", "INT"}, {"price", "DECIMAL"}, {"sold", "DATETIME"}, {"note", "VARCHAR"}}
+	row := map[string]interface{}{"qty": "42", "price": "12.50", "sold": "2024-03-01 10:00:00", "note": "007"}
+
+	w := NewExcelWriter(nil)
+	if err := w.WriteRows(columns, []map[string]interface{}{row}); err != nil {
+		t.Fatal(err)
+	}
+	if row["qty"] != "42" || row["price"] != "12.50" {
+		t.Fatalf("WriteRows changed the caller's row: %v", row)
+	}
+
+	// Numbers, including dates as serials, are cells without a type.
+	for cell, wantText := range map[string]bool{"A2": false, "B2": false, "C2": false, "D2": true} {
+		cellType, err := w.File.GetCellType(w.SheetName, cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isText := cellType == excelize.CellTypeSharedString || cellType == excelize.CellTypeInlineString; isText != wantText {
+			t.Errorf("%s: text %v, want %v", cell, isText, wantText)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"go-report-management/structs"
+	"log"
+	"strings"
+)
+
+const pivotSheetName = "Pivot"
+
+var pivotSubtotals = map[string]string{
+	"sum":   "Sum",
+	"avg":   "Average",
+	"count": "Count",
+	"min":   "Min",
+	"max":   "Max",
+}
+
+func ParsePivotSpec(raw string) (*structs.PivotSpec, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	var spec structs.PivotSpec
+	if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+		return nil, fmt.Errorf("invalid pivot definition: %v", err)
+	}
+	if len(spec.Rows) == 0 || spec.Column == "" || spec.Value == "" {
+		return nil, fmt.Errorf("pivot definition needs rows, a column and a value")
+	}
+	for _, row := range spec.Rows {
+		if row == spec.Column {
+			return nil, fmt.Errorf("pivot column %s is also a row", row)
+		}
+	}
+	spec.Aggregate = strings.ToLower(spec.Aggregate)
+	if spec.Aggregate == "" {
+		spec.Aggregate = "sum"
+	}
+	if _, ok := pivotSubtotals[spec.Aggregate]; !ok {
+		return nil, fmt.Errorf("unsupported pivot aggregate: %s", spec.Aggregate)
+	}
+	return &spec, nil
+}
+
+// collectPivotRow records the row key and column value of a written row.
+func (w *ExcelWriter) collectPivotRow(result map[string]interface{}) {
+	key := make([]string, len(w.Pivot.Rows))
+	for i, name := range w.Pivot.Rows {
+		key[i] = fmt.Sprint(result[name])
+	}
+	w.pivotRowKeys[strings.Join(key, "\x00")] = true
+	w.pivotColumns[fmt.Sprint(result[w.Pivot.Column])] = true
+}
+
+// addPivotSheet adds a pivot table over the data sheet. A pivot table has a
+// single source range, so an export that spilled onto more sheets gets
+// none rather than one that silently leaves rows out.
+func (w *ExcelWriter) addPivotSheet() error {
+	if w.Pivot == nil || len(w.sheets) == 0 || w.sheets[0].lastRow < 2 {
+		return nil
+	}
+	if len(w.sheets) > 1 {
+		log.Printf("skipping pivot table: data spans %d sheets", len(w.sheets))
+		return nil
+	}
+	data := w.sheets[0]
+
+	field := func(name string) (excelize.PivotTableField, error) {
+		for _, column := range w.Columns {
+			if column.Name == name {
+				return excelize.PivotTableField{Data: w.headerLabel(column)}, nil
+			}
+		}
+		return excelize.PivotTableField{}, fmt.Errorf("pivot column %s not found", name)
+	}
+
+	dataRange, err := pivotRef(data.name, fmt.Sprintf("$A$1:$%s$%d", mustColumnName(len(w.Columns)), data.lastRow))
+	if err != nil {
+		return err
+	}
+	pivotRange, err := pivotRef(pivotSheetName, w.pivotTableCells())
+	if err != nil {
+		return err
+	}
+	opts := &excelize.PivotTableOptions{
+		DataRange:       dataRange,
+		PivotTableRange: pivotRange,
+		RowGrandTotals:  true,
+		ColGrandTotals:  true,
+		ShowRowHeaders:  true,
+		ShowColHeaders:  true,
+		ShowLastColumn:  true,
+	}
+	for _, name := range w.Pivot.Rows {
+		rowField, err := field(name)
+		if err != nil {
+			return err
+		}
+		opts.Rows = append(opts.Rows, rowField)
+	}
+	columnField, err := field(w.Pivot.Column)
+	if err != nil {
+		return err
+	}
+	opts.Columns = []excelize.PivotTableField{columnField}
+
+	valueField, err := field(w.Pivot.Value)
+	if err != nil {
+		return err
+	}
+	valueField.Subtotal = pivotSubtotals[w.Pivot.Aggregate]
+	valueField.Name = fmt.Sprintf("%s of %s", valueField.Subtotal, valueField.Data)
+	opts.Data = []excelize.PivotTableField{valueField}
+
+	if _, err := w.File.NewSheet(pivotSheetName); err != nil {
+		return err
+	}
+	return w.File.AddPivotTable(opts)
+}
+
+// pivotTableCells is where the pivot table lands: below two rows left for
+// the filter area, one column per row field plus one per distinct column
+// value and the grand total, and a row per distinct row key plus the two
+// header rows and the grand total.
+func (w *ExcelWriter) pivotTableCells() string {
+	const firstRow = 3
+	lastCol := len(w.Pivot.Rows) + len(w.pivotColumns) + 1
+	lastRow := firstRow + 2 + len(w.pivotRowKeys)
+	return fmt.Sprintf("$A$%d:$%s$%d", firstRow, mustColumnName(lastCol), lastRow)
+}
+
+// pivotRef is a range for AddPivotTable. Unlike a formula reference, it
+// takes the sheet name unquoted: excelize splits the range at "!" and
+// rejects names quoted with "'", so it can't address a sheet whose name
+// contains "!".
+func pivotRef(sheet, cells string) (string, error) {
+	if strings.Contains(sheet, "!") {
+		return "", fmt.Errorf("sheet name %q can't be used in a pivot table range", sheet)
+	}
+	return sheet + "!" + cells, nil
+}
+
+func mustColumnName(num int) string {
+	name, _ := excelize.ColumnNumberToName(num)
+	return name
+}
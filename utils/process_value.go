@@ -3,6 +3,8 @@ package utils
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -71,3 +73,65 @@ func ProcessValue(val interface{}) (interface{}, error) {
 		return nil, fmt.Errorf("unsupported type: %T", v)
 	}
 }
+
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// ConvertColumnValue types a MySQL text value by its column's database
+// type. It takes the driver's []byte or the string ProcessValue made of it.
+// Report rows keep those strings in the JSON API; Excel exports and chart
+// data are converted.
+func ConvertColumnValue(val interface{}, databaseType string) (interface{}, error) {
+	var raw []byte
+	switch v := val.(type) {
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	case time.Time:
+		return v, nil
+	default:
+		return ProcessValue(val)
+	}
+
+	s := string(raw)
+	switch strings.TrimPrefix(databaseType, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT", "YEAR":
+		if strings.HasPrefix(databaseType, "UNSIGNED ") {
+			if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return n, nil
+			}
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+	case "FLOAT", "DOUBLE":
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n, nil
+		}
+	case "DECIMAL", "NUMERIC":
+		// Kept as the exact string; a float64 would round amounts. The
+		// Excel writer converts them, Excel stores doubles anyway.
+		return s, nil
+	case "DATE", "DATETIME", "TIMESTAMP":
+		if strings.HasPrefix(s, "0000-00-00") {
+			return nil, nil
+		}
+		for _, layout := range dateLayouts {
+			if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+				return t, nil
+			}
+		}
+	case "BIT":
+		var n uint64
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, nil
+	}
+
+	return s, nil
+}
@@ -0,0 +1,85 @@
+package websockets
+
+import (
+	"encoding/json"
+	"log"
+)
+
+const (
+	CommandStartExport = "start_export"
+	CommandCancel      = "cancel"
+	CommandSubscribe   = "subscribe"
+	CommandUnsubscribe = "unsubscribe"
+	CommandListJobs    = "list_jobs"
+)
+
+// Command is a request a v1 client sends over the socket, e.g.
+// {"type": "cancel", "request_id": "7", "job_id": "..."}.
+type Command struct {
+	Type      string            `json:"type"`
+	RequestID string            `json:"request_id,omitempty"`
+	ReportID  int               `json:"report_id,omitempty"`
+	JobID     string            `json:"job_id,omitempty"`
+	Filters   map[string]string `json:"filters,omitempty"`
+	Format    string            `json:"format,omitempty"`
+	Pivot     json.RawMessage   `json:"pivot,omitempty"`
+}
+
+// Reply answers exactly one Command and is never replayed.
+type Reply struct {
+	Version   int         `json:"v"`
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id,omitempty"`
+	Command   string      `json:"command"`
+	OK        bool        `json:"ok"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// CommandHandler runs cmd on behalf of the authenticated user behind
+// client. The handler is set by the routes so it can reach the services
+// without this package depending on them.
+type CommandHandler func(client *Client, cmd Command) (interface{}, error)
+
+func (c *Client) handleCommand(raw []byte) {
+	if c.protocol == ProtocolLegacy {
+		return
+	}
+
+	var cmd Command
+	reply := Reply{Version: c.protocol, Type: "reply"}
+	if err := json.Unmarshal(raw, &cmd); err != nil {
+		reply.Error = "invalid command"
+		c.reply(reply)
+		return
+	}
+	reply.RequestID = cmd.RequestID
+	reply.Command = cmd.Type
+
+	if c.hub.Commands == nil {
+		reply.Error = "commands are not available"
+		c.reply(reply)
+		return
+	}
+
+	data, err := c.hub.Commands(c, cmd)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.OK = true
+		reply.Data = data
+	}
+	c.reply(reply)
+}
+
+func (c *Client) reply(reply Reply) {
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	select {
+	case c.replies <- payload:
+	default:
+		log.Printf("dropping reply to websocket client %s for user %s", c.ID, c.User)
+	}
+}
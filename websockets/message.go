@@ -0,0 +1,38 @@
+package websockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-report-management/events"
+)
+
+// Protocol versions a client can negotiate with the "reports.v<N>"
+// subprotocol or the ?protocol=<N> query parameter. Clients that ask for
+// nothing get ProtocolLegacy, the bare strings sent before versioning.
+const (
+	ProtocolLegacy = 0
+	ProtocolV1     = 1
+
+	SubprotocolV1 = "reports.v1"
+)
+
+// encode renders msg for a client speaking protocol. It returns nil when
+// the message has no representation in that protocol.
+func encode(msg events.Message, protocol int) []byte {
+	if protocol == ProtocolLegacy {
+		switch msg.Type {
+		case events.MessageProgress:
+			return []byte(fmt.Sprintf("%.2f%%", msg.Percent))
+		case events.MessageCompleted:
+			return []byte(msg.URL)
+		}
+		return nil
+	}
+
+	msg.Version = protocol
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return payload
+}
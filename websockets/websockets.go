@@ -1,108 +1,202 @@
 package websockets
 
 import (
+	"expvar"
 	"github.com/gorilla/websocket"
+	"go-report-management/events"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxMessageSize = 4096
+)
+
+var (
+	activeConnections = expvar.NewInt("websocket_connections_active")
+	openedConnections = expvar.NewInt("websocket_connections_opened")
+	closedConnections = expvar.NewInt("websocket_connections_closed")
+)
+
+// The upgrader only ever selects SubprotocolV1, so a "bearer.<token>"
+// entry is never echoed back in the handshake response.
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	Subprotocols: []string{SubprotocolV1},
 }
 
 type Client struct {
-	ID   string
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte
+	ID     string
+	User   string
+	SiteID uint
+	// IssuedAt is when the handshake's token was issued; commands check it
+	// against the user's session revocations.
+	IssuedAt time.Time
+	hub      *Hub
+	conn     *websocket.Conn
+	sub      *events.Subscription
+	replies  chan []byte
+	protocol int
 }
 
+// Hub tracks the live WebSocket connections. Delivery itself goes through
+// bus, which the SSE transport shares.
 type Hub struct {
-	clients    map[*Client]bool
-	clientsMap map[string]*Client
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
+	mu       sync.Mutex
+	clients  map[*Client]bool
+	bus      *events.Bus
+	Commands CommandHandler
 }
 
-var HubInstance = &Hub{
-	broadcast:  make(chan []byte),
-	register:   make(chan *Client),
-	unregister: make(chan *Client),
-	clients:    make(map[*Client]bool),
-	clientsMap: make(map[string]*Client),
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*Client]bool)}
 }
 
-func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-			h.clientsMap[client.ID] = client
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				delete(h.clientsMap, client.ID)
-				close(client.send)
-			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
-		}
-	}
+var HubInstance = NewHub()
+
+// register subscribes client to its user's events, replaying every retained
+// message after lastSeq.
+func (h *Hub) register(client *Client, lastSeq uint64) {
+	client.sub = h.bus.Subscribe(client.User, lastSeq)
+
+	h.mu.Lock()
+	h.clients[client] = true
+	h.mu.Unlock()
+
+	activeConnections.Add(1)
+	openedConnections.Add(1)
+}
+
+func (h *Hub) unregister(client *Client) {
+	h.bus.Unsubscribe(client.sub)
+
+	h.mu.Lock()
+	delete(h.clients, client)
+	h.mu.Unlock()
+
+	activeConnections.Add(-1)
+	closedConnections.Add(1)
 }
 
+// readPump owns the connection's lifetime: it is the only place a client is
+// unregistered. A missed pong lets the read deadline expire, which ends the
+// loop the same way a closed socket does.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.unregister(c)
 		c.conn.Close()
 	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
-		_, _, err := c.conn.ReadMessage()
+		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
-			c.hub.unregister <- c
-			c.conn.Close()
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket client %s for user %s: %v", c.ID, c.User, err)
+			}
 			break
 		}
+		if messageType == websocket.TextMessage {
+			c.handleCommand(message)
+		}
 	}
 }
 
 func (c *Client) writePump() {
-	for message := range c.send {
-		err := c.conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			break
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.sub.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			payload := encode(message, c.protocol)
+			if payload == nil {
+				continue
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case payload := <-c.replies:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, clientID string) {
+// ServeWs upgrades an already authenticated request; user is the principal
+// the connection belongs to and siteID the active site of its token.
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, clientID, user string, siteID uint, issuedAt time.Time) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{ID: clientID, hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+	lastSeq, _ := strconv.ParseUint(r.URL.Query().Get("last_seq"), 10, 64)
+	client := &Client{ID: clientID, User: user, SiteID: siteID, IssuedAt: issuedAt, hub: hub, conn: conn, replies: make(chan []byte, 16), protocol: negotiateProtocol(conn, r)}
+	client.hub.register(client, lastSeq)
 
 	go client.writePump()
 	go client.readPump()
 }
 
-func InitHub() {
-	go HubInstance.run()
+func InitHub(bus *events.Bus) {
+	HubInstance.bus = bus
+	upgrader.CheckOrigin = originChecker(os.Getenv("WS_ALLOWED_ORIGINS"))
+}
+
+// originChecker builds the upgrader's origin check from a comma-separated
+// allow-list. "*" allows any origin; an empty list keeps gorilla's default
+// same-host check.
+func originChecker(allowList string) func(r *http.Request) bool {
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(allowList, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowed["*"] || allowed[strings.ToLower(origin)]
+	}
 }
 
-func NotifyClient(clientID string, message string) {
-	if client, ok := HubInstance.clientsMap[clientID]; ok {
-		client.send <- []byte(message)
+func negotiateProtocol(conn *websocket.Conn, r *http.Request) int {
+	if conn.Subprotocol() == SubprotocolV1 {
+		return ProtocolV1
+	}
+	if protocol, err := strconv.Atoi(r.URL.Query().Get("protocol")); err == nil && protocol == ProtocolV1 {
+		return ProtocolV1
 	}
+	return ProtocolLegacy
 }